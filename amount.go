@@ -1,6 +1,13 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
 
 type Amount int64 // in milliunits
 
@@ -8,8 +15,216 @@ func (a Amount) String() string {
 	return fmt.Sprintf("$%.2f", float64(a)/1000)
 }
 
-func (a Amount) RoundedUpToDeciCents() Amount {
-	return (a + 99) / 100 * 100
+// Decimal formats the amount exactly, without trailing zeros, e.g. "-12.5".
+func (a Amount) Decimal() string {
+	sign := ""
+	u := uint64(a)
+	if a < 0 {
+		sign = "-"
+		u = -u
+	}
+	s := sign + strconv.FormatUint(u/1000, 10)
+	if frac := u % 1000; frac != 0 {
+		s += "." + strings.TrimRight(fmt.Sprintf("%03d", frac), "0")
+	}
+	return s
+}
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// ParseAmount parses a decimal number like "1 234,5" or "1,234.50" exactly
+// into milliunits.
+//
+// Both dot and comma are accepted as the decimal separator. When both occur,
+// the last one is the decimal separator and the other one groups thousands;
+// a separator that occurs several times groups thousands; a single separator
+// is the decimal one, so "1,234" means 1.234. Spaces and apostrophes always
+// group thousands.
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		neg, s = true, rest
+	} else if rest, ok := strings.CutPrefix(s, "+"); ok {
+		s = rest
+	}
+
+	decimalSep := rune(0)
+	if i := strings.LastIndexAny(s, ".,"); i >= 0 {
+		sep := rune(s[i])
+		other := ','
+		if sep == ',' {
+			other = '.'
+		}
+		if strings.ContainsRune(s, other) || strings.Count(s, string(sep)) == 1 {
+			decimalSep = sep
+		}
+	}
+
+	intPart, fracPart := s, ""
+	if decimalSep != 0 {
+		i := strings.LastIndexByte(s, byte(decimalSep))
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	if intPart == "" && fracPart == "" || decimalSep != 0 && strings.ContainsRune(intPart, decimalSep) {
+		return 0, errInvalidAmount
+	}
+	digits, ok := ungroup(intPart)
+	if !ok {
+		return 0, errInvalidAmount
+	}
+	if decimalSep != 0 && (fracPart == "" || !isDigits(fracPart)) {
+		return 0, errInvalidAmount
+	}
+	if len(fracPart) > 3 {
+		return 0, errors.New("amounts have at most 3 decimal places")
+	}
+
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || units > maxAmountUnits {
+		return 0, errInvalidAmount
+	}
+	frac, _ := strconv.ParseInt((fracPart + "000")[:3], 10, 64)
+	a := Amount(units*1000 + frac)
+	if neg {
+		a = -a
+	}
+	return a, nil
+}
+
+// ParseAmount parses an amount entered in the currency. Unlike the generic
+// ParseAmount, a lone dot or comma is read as the currency's group separator
+// when the digits after it come in threes, so "1.234" is 1234 for a currency
+// written like 1.234,56.
+func (c *Currency) ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	g := c.GroupSeparator
+	if (g == "." || g == ",") && strings.Count(s, g) == 1 && !strings.Contains(s, c.DecimalSeparator) {
+		if digits, ok := ungroup(strings.TrimLeft(s, "+-")); ok {
+			return ParseAmount(s[:len(s)-len(digits)-1] + digits)
+		}
+	}
+	return ParseAmount(s)
+}
+
+// maxAmountUnits keeps parsed amounts well away from int64 overflow
+const maxAmountUnits = 1_000_000_000_000
+
+func isGroupSeparator(r rune) bool {
+	switch r {
+	case ' ', '\u00a0', '\u202f', '\'', '’', '.', ',':
+		return true
+	}
+	return false
+}
+
+// ungroup removes thousands separators from the integer part of a number,
+// checking that every group but the first one has three digits.
+func ungroup(s string) (string, bool) {
+	if s == "" {
+		return "0", true // like ".5"
+	}
+	var b strings.Builder
+	group, first := 0, true
+	for _, r := range s {
+		if isGroupSeparator(r) {
+			if group == 0 || (!first && group != 3) {
+				return "", false
+			}
+			group, first = 0, false
+			continue
+		}
+		if r < '0' || r > '9' {
+			return "", false
+		}
+		b.WriteRune(r)
+		group++
+	}
+	if group == 0 || (!first && group != 3) {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// RoundingMode says how a converted amount is rounded to the precision kept
+// for a currency.
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // to nearest, ties to even
+	RoundUp                           // away from zero
+	RoundDown                         // toward zero
+)
+
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch s {
+	case "", "half-even":
+		return RoundHalfEven, nil
+	case "up":
+		return RoundUp, nil
+	case "down":
+		return RoundDown, nil
+	default:
+		return 0, fmt.Errorf("unknown rounding mode %q, expected half-even, up or down", s)
+	}
+}
+
+func (m RoundingMode) String() string {
+	switch m {
+	case RoundUp:
+		return "up"
+	case RoundDown:
+		return "down"
+	default:
+		return "half-even"
+	}
+}
+
+// roundRat rounds an exact amount in milliunits to a multiple of unit.
+func roundRat(r *big.Rat, unit Amount, mode RoundingMode) Amount {
+	q := new(big.Rat).Quo(r, new(big.Rat).SetInt64(int64(unit)))
+	num, den := q.Num(), q.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int)) // truncates toward zero
+	if rem.Sign() != 0 {
+		away := false
+		switch mode {
+		case RoundUp:
+			away = true
+		case RoundHalfEven:
+			twice := rem.Abs(rem).Lsh(rem, 1)
+			c := twice.Cmp(den)
+			away = c > 0 || (c == 0 && quo.Bit(0) == 1)
+		}
+		if away {
+			quo.Add(quo, big.NewInt(int64(num.Sign())))
+		}
+	}
+	return Amount(quo.Int64()) * unit
+}
+
+// ratFromFloat returns the decimal value a float64 rate was written as
+// (2.6 rather than its nearest binary fraction).
+func ratFromFloat(f float64) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid rate %v", f)
+	}
+	return r, nil
+}
+
+// validRate reports whether a rate can be converted with
+func validRate(f float64) bool {
+	return f > 0 && !math.IsInf(f, 0) && !math.IsNaN(f)
 }
 
 type Monetary struct {
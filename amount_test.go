@@ -0,0 +1,212 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Amount
+	}{
+		{"12", 12_000},
+		{"12.5", 12_500},
+		{"12,5", 12_500},
+		{" 0.001 ", 1},
+		{".5", 500},
+		{"-3.25", -3_250},
+		{"+3", 3_000},
+		{"1,234", 1_234},
+		{"1,234.56", 1_234_560},
+		{"1.234,56", 1_234_560},
+		{"1 234,56", 1_234_560},
+		{"1 234 567", 1_234_567_000},
+		{"1'234.5", 1_234_500},
+		{"1,234,567", 1_234_567_000},
+		{"1.234.567", 1_234_567_000},
+		{"0.1", 100},
+	}
+	for _, tt := range tests {
+		actual, err := ParseAmount(tt.input)
+		if err != nil {
+			t.Errorf("ParseAmount(%q) failed: %v", tt.input, err)
+		} else if actual != tt.expected {
+			t.Errorf("ParseAmount(%q) = %d, wanted %d", tt.input, actual, tt.expected)
+		}
+	}
+
+	for _, input := range []string{"", "-", ".", "abc", "12,5o", "1.2345", "1,23,456", "1,234.5,6", "1 23", "12.", "1e3", "99999999999999999"} {
+		if a, err := ParseAmount(input); err == nil {
+			t.Errorf("ParseAmount(%q) = %d, wanted an error", input, a)
+		}
+	}
+}
+
+func TestCurrencyParseAmount(t *testing.T) {
+	eur := &Currency{Code: "EUR", DecimalSeparator: ",", GroupSeparator: "."}
+	tests := []struct {
+		input    string
+		expected Amount
+	}{
+		{"1.234", 1_234_000},
+		{"-1.234", -1_234_000},
+		{"12.5", 12_500},
+		{"12,5", 12_500},
+		{"1.234,5", 1_234_500},
+	}
+	for _, tt := range tests {
+		actual, err := eur.ParseAmount(tt.input)
+		if err != nil {
+			t.Errorf("ParseAmount(%q) failed: %v", tt.input, err)
+		} else if actual != tt.expected {
+			t.Errorf("ParseAmount(%q) = %d, wanted %d", tt.input, actual, tt.expected)
+		}
+	}
+}
+
+func TestParseAmount_roundTrip(t *testing.T) {
+	prop := func(v int64, sep uint8) bool {
+		a := Amount(v % (maxAmountUnits * 1000))
+		s := a.Decimal()
+		if sep%2 == 1 {
+			s = groupThousands(strings.ReplaceAll(s, ".", ","), ".")
+		} else {
+			s = groupThousands(s, " ")
+		}
+		parsed, err := ParseAmount(s)
+		return err == nil && parsed == a
+	}
+	if err := quick.Check(prop, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// groupThousands inserts sep between groups of three digits of the integer
+// part of a formatted number.
+func groupThousands(s, sep string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	end := strings.IndexAny(s, ".,")
+	if end < 0 {
+		end = len(s)
+	}
+	intPart, rest := s[:end], s[end:]
+	for i := len(intPart) - 3; i > 0; i -= 3 {
+		intPart = intPart[:i] + sep + intPart[i:]
+	}
+	return sign + intPart + rest
+}
+
+func TestRoundRat(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		mode     RoundingMode
+		expected Amount
+	}{
+		{25, 10, RoundHalfEven, 2},
+		{35, 10, RoundHalfEven, 4},
+		{-25, 10, RoundHalfEven, -2},
+		{-35, 10, RoundHalfEven, -4},
+		{21, 10, RoundUp, 3},
+		{-21, 10, RoundUp, -3},
+		{29, 10, RoundDown, 2},
+		{-29, 10, RoundDown, -2},
+		{-26, 10, RoundHalfEven, -3},
+	}
+	for _, tt := range tests {
+		actual := roundRat(big.NewRat(tt.num, tt.den), 1, tt.mode)
+		if actual != tt.expected {
+			t.Errorf("roundRat(%d/%d, %v) = %d, wanted %d", tt.num, tt.den, tt.mode, actual, tt.expected)
+		}
+	}
+}
+
+func TestRoundRat_properties(t *testing.T) {
+	prop := func(num int64, den uint16, unitExp uint8, modeIdx uint8) bool {
+		num %= 1 << 40
+		r := big.NewRat(num, int64(den)+1)
+		unit := Amount([]int64{1, 10, 100, 1000}[unitExp%4])
+		mode := RoundingMode(modeIdx % 3)
+
+		rounded := roundRat(r, unit, mode)
+		if rounded%unit != 0 {
+			return false
+		}
+		// Rounding is symmetric around zero in all modes
+		if roundRat(new(big.Rat).Neg(r), unit, mode) != -rounded {
+			return false
+		}
+
+		diff := new(big.Rat).Sub(new(big.Rat).SetInt64(int64(rounded)), r)
+		dist := new(big.Rat).Abs(diff)
+		if dist.Cmp(new(big.Rat).SetInt64(int64(unit))) >= 0 {
+			return false
+		}
+		switch mode {
+		case RoundUp:
+			return new(big.Rat).Abs(new(big.Rat).SetInt64(int64(rounded))).Cmp(new(big.Rat).Abs(r)) >= 0
+		case RoundDown:
+			return new(big.Rat).Abs(new(big.Rat).SetInt64(int64(rounded))).Cmp(new(big.Rat).Abs(r)) <= 0
+		default:
+			return dist.Cmp(big.NewRat(int64(unit), 2)) <= 0
+		}
+	}
+	if err := quick.Check(prop, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConvertAmount_properties(t *testing.T) {
+	usd := &Currency{Code: "USD", Rate: 1, Prefix: "$"}
+	gel := &Currency{Code: "GEL", Rate: 2.6, Prefix: "₾"}
+	app := &App{BudgetCurrency: usd, Rates: NewRateStore()}
+	date := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	convert := func(a Amount, from, to *Currency) Amount {
+		converted, err := app.ConvertAmount(a, from, to, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return converted
+	}
+
+	prop := func(v int32, modeIdx uint8) bool {
+		a := Amount(v)
+		usd.Rounding = RoundingMode(modeIdx % 3)
+		gel.Rounding = usd.Rounding
+		if convert(-a, gel, usd) != -convert(a, gel, usd) {
+			return false
+		}
+		// Budget to currency at 2.6 is exact
+		return convert(a*10, usd, gel) == a*26
+	}
+	if err := quick.Check(prop, nil); err != nil {
+		t.Error(err)
+	}
+
+	usd.Rounding = RoundHalfEven
+	if actual := convert(-1_300, gel, usd); actual != -500 {
+		t.Errorf("ConvertAmount(-₾1.30) = %d, wanted -500", actual)
+	}
+
+	// A rate that can't be divided by is an error rather than a panic
+	gel.Rate = 0
+	if _, err := app.ConvertAmount(-1_300, gel, usd, date); err == nil {
+		t.Errorf("Expected an error for a zero rate")
+	}
+}
+
+func TestNewCurrency_rate(t *testing.T) {
+	for _, rate := range []float64{0, -2.6, math.NaN(), math.Inf(1)} {
+		if _, err := newCurrency(CurrencyConfig{Code: "GEL", Rate: rate}); err == nil {
+			t.Errorf("Expected an error for rate %v", rate)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreyvit/mvp/httpcall"
+)
+
+const (
+	maxAPIRequestSize  = 1 << 20
+	defaultAPITxLimit  = maxVisibleTxCount
+	maxAPITxLimit      = 1000
+	maxImportIDLength  = 36 // YNAB's limit
+	apiTokenAuthPrefix = "Bearer "
+)
+
+// apiError is the error response of the JSON API, sent as {"error": {...}}
+type apiError struct {
+	Status      int               `json:"-"`
+	Code        string            `json:"code"`
+	Message     string            `json:"message"`
+	Fields      map[string]string `json:"fields,omitempty"`      // validation messages by input field
+	Transaction *v1Transaction    `json:"transaction,omitempty"` // the similar one, for duplicates
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// apiTokens maps the SHA-256 of each API token to the user it acts as.
+// Looking up hashes keeps the tokens themselves out of timing differences.
+type apiTokens map[string]*User
+
+func newAPITokens(cfg *AppConfig, auth *authenticator) (apiTokens, error) {
+	tokens := make(apiTokens, len(cfg.APITokens))
+	for _, t := range cfg.APITokens {
+		hash := strings.ToLower(t.TokenHash)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api token %s: token_sha256 must be a hex SHA-256 hash", t.Name)
+		}
+		if t.Name == "" || tokens[hash] != nil {
+			return nil, fmt.Errorf("api tokens need a name and a unique hash, got %q", t.Name)
+		}
+		u := &User{Name: t.Name}
+		if t.User != "" {
+			if auth != nil {
+				u = auth.Users[t.User]
+			}
+			if u == nil {
+				return nil, fmt.Errorf("api token %s: unknown user %q", t.Name, t.User)
+			}
+		}
+		tokens[hash] = u
+	}
+	return tokens, nil
+}
+
+// userFromRequest returns the user of the bearer token, if it's a known one
+func (tokens apiTokens) userFromRequest(r *http.Request) *User {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), apiTokenAuthPrefix)
+	if !ok || token == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	return tokens[hex.EncodeToString(sum[:])]
+}
+
+// routeAPI is like route, but authenticates with an API token and reports
+// errors as JSON
+func routeAPI(h func(app *App, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apps := currentApps.Load()
+		err := func() error {
+			app := apps.profileApp(r)
+			if app == nil {
+				return &apiError{Status: http.StatusNotFound, Code: "not_found", Message: "No such profile."}
+			}
+			u := apps.APITokens.userFromRequest(r)
+			if u == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				return &apiError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Send a valid API token as Authorization: Bearer <token>."}
+			} else if !u.canUseProfile(app.Profile) {
+				return &apiError{Status: http.StatusForbidden, Code: "forbidden", Message: "This token doesn't have access to this profile."}
+			}
+			return h(app, w, r.WithContext(withUser(r.Context(), u)))
+		}()
+		if err != nil {
+			writeAPIError(w, r, err)
+		}
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	var verr *ValidationError
+	var callErr *httpcall.Error
+	var sizeErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &e):
+	case errors.As(err, &verr):
+		e = &apiError{Status: http.StatusUnprocessableEntity, Code: "invalid", Message: verr.Error(), Fields: verr.Fields}
+	case errors.As(err, &sizeErr):
+		e = &apiError{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: err.Error()}
+	case isRateLimited(err):
+		e = &apiError{Status: http.StatusServiceUnavailable, Code: "ynab_rate_limited", Message: "YNAB rate limited, try again later"}
+	case errors.As(err, &callErr):
+		log.Printf("WARNING: %s %s failed: %v", r.Method, r.URL.Path, err)
+		e = &apiError{Status: http.StatusBadGateway, Code: "ynab_error", Message: err.Error()}
+	default:
+		log.Printf("WARNING: %s %s failed: %v", r.Method, r.URL.Path, err)
+		e = &apiError{Status: http.StatusInternalServerError, Code: "internal_error", Message: err.Error()}
+	}
+	writeJSON(w, e.Status, map[string]any{"error": e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+type v1Account struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Balance *Amount `json:"balance,omitempty"` // milliunits of the budget currency, absent if hidden
+}
+
+type v1Category struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	TransferAccountID string `json:"transfer_account_id,omitempty"` // for "Transfer to" categories
+}
+
+type v1Currency struct {
+	Code     string  `json:"code"`
+	Rate     float64 `json:"rate"` // today's, units per budget currency unit
+	Decimals int     `json:"decimals"`
+	Default  bool    `json:"default,omitempty"`
+	Budget   bool    `json:"budget,omitempty"`
+}
+
+// v1Transaction is a transaction as the API returns it. Amounts are in
+// milliunits of the budget currency, negative for outflows, like in YNAB.
+type v1Transaction struct {
+	ID                string              `json:"id"`
+	Date              string              `json:"date"`
+	Amount            Amount              `json:"amount"`
+	AccountID         string              `json:"account_id"`
+	AccountName       string              `json:"account_name"`
+	CategoryID        string              `json:"category_id"`
+	CategoryName      string              `json:"category_name"`
+	TransferAccountID string              `json:"transfer_account_id,omitempty"`
+	PayeeID           string              `json:"payee_id,omitempty"`
+	PayeeName         string              `json:"payee_name,omitempty"`
+	Memo              string              `json:"memo"`
+	Receipts          []string            `json:"receipts,omitempty"` // URLs
+	Subtransactions   []*v1Subtransaction `json:"subtransactions,omitempty"`
+}
+
+type v1Subtransaction struct {
+	Amount       Amount `json:"amount"`
+	CategoryID   string `json:"category_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty"`
+	Memo         string `json:"memo"`
+}
+
+func (app *App) v1Transaction(r *http.Request, tx *YNABTransaction, receipts []string) *v1Transaction {
+	result := &v1Transaction{
+		ID:        tx.ID,
+		Date:      tx.Date,
+		Amount:    tx.Amount,
+		PayeeID:   tx.PayeeID,
+		PayeeName: tx.PayeeName,
+		Memo:      tx.Comment,
+	}
+	if tx.Account != nil {
+		result.AccountID, result.AccountName = tx.Account.ID, tx.Account.Name
+	}
+	if tx.Category != nil {
+		result.CategoryID, result.CategoryName = tx.Category.ID, tx.Category.Name
+	}
+	if tx.TransferAccount != nil {
+		result.TransferAccountID = tx.TransferAccount.ID
+	}
+	for _, name := range receipts {
+		result.Receipts = append(result.Receipts, app.receiptURL(r, name))
+	}
+	for _, sub := range tx.Subtransactions {
+		s := &v1Subtransaction{Amount: sub.Amount, Memo: sub.Comment}
+		if sub.Category != nil {
+			s.CategoryID, s.CategoryName = sub.Category.ID, sub.Category.Name
+		}
+		result.Subtransactions = append(result.Subtransactions, s)
+	}
+	return result
+}
+
+// v1Amount is an amount given either as a JSON number like 12.5 or as a
+// string written the way the form accepts it, like "12,50"
+type v1Amount struct {
+	Value  string
+	Number bool
+}
+
+func (a *v1Amount) UnmarshalJSON(raw []byte) error {
+	if bytes.HasPrefix(raw, []byte(`"`)) {
+		return json.Unmarshal(raw, &a.Value)
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return err
+	}
+	a.Value, a.Number = n.String(), n != ""
+	return nil
+}
+
+// formValue returns the amount as it would be typed into the form
+func (a v1Amount) formValue(currency *Currency) string {
+	if !a.Number {
+		return a.Value
+	}
+	amount, err := ParseAmount(a.Value)
+	if err != nil {
+		return a.Value // reported by parseExpenseForm
+	}
+	if currency == nil {
+		return amount.Decimal()
+	}
+	return formatAmountInput(amount, currency)
+}
+
+// v1TransactionInput mirrors the expense form. The account and categories
+// can be given by ID or by name.
+type v1TransactionInput struct {
+	Date           string         `json:"date"` // YYYY-MM-DD, today if empty
+	Amount         v1Amount       `json:"amount"`
+	Currency       string         `json:"currency"` // the default one if empty
+	Account        string         `json:"account"`
+	Category       string         `json:"category"`
+	Payee          string         `json:"payee"` // name, a new one is created in YNAB
+	Comment        string         `json:"comment"`
+	Splits         []v1SplitInput `json:"splits"`
+	Token          string         `json:"token"` // makes retries safe, sent to YNAB as import_id
+	AllowDuplicate bool           `json:"allow_duplicate"`
+}
+
+type v1SplitInput struct {
+	Category string   `json:"category"`
+	Amount   v1Amount `json:"amount"`
+	Comment  string   `json:"comment"`
+}
+
+// decodeTransactionInput reads the request body into form values that
+// parseExpenseForm understands
+func (app *App) decodeTransactionInput(w http.ResponseWriter, r *http.Request, data *YNABData) (url.Values, error) {
+	var in v1TransactionInput
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		if sizeErr := (*http.MaxBytesError)(nil); errors.As(err, &sizeErr) {
+			return nil, err
+		}
+		return nil, &apiError{Status: http.StatusBadRequest, Code: "invalid_json", Message: err.Error()}
+	}
+	if len(in.Token) > maxImportIDLength {
+		return nil, &ValidationError{Fields: map[string]string{"token": fmt.Sprintf("Use at most %d characters.", maxImportIDLength)}}
+	}
+
+	if in.Currency == "" {
+		in.Currency = app.DefaultCurrency.Code
+	}
+	currency := app.CurrenciesByCode[in.Currency]
+	values := url.Values{
+		"date":     {in.Date},
+		"amount":   {in.Amount.formValue(currency)},
+		"currency": {in.Currency},
+		"account":  {accountIDByName(data, in.Account)},
+		"category": {categoryIDByName(data, in.Category)},
+		"payee":    {in.Payee},
+		"comment":  {in.Comment},
+	}
+	for _, split := range in.Splits {
+		values.Add("split_category", categoryIDByName(data, split.Category))
+		values.Add("split_amount", split.Amount.formValue(currency))
+		values.Add("split_comment", split.Comment)
+	}
+	if in.Token != "" {
+		values.Set("token", in.Token)
+	}
+	if in.AllowDuplicate {
+		values.Set("allow_duplicate", "1")
+	}
+	return values, nil
+}
+
+// accountIDByName returns the ID of the account given by ID or by name,
+// or s itself if there's no such account
+func accountIDByName(data *YNABData, s string) string {
+	for _, a := range data.Accounts {
+		if a.ID == s || strings.EqualFold(a.Name, s) {
+			return a.ID
+		}
+	}
+	return s
+}
+
+// categoryIDByName is like accountIDByName, for categories including the
+// "Transfer to" ones
+func categoryIDByName(data *YNABData, s string) string {
+	if data.CategoryByID(s) != nil {
+		return s
+	}
+	for _, c := range data.AllCategories {
+		if strings.EqualFold(c.Name, s) {
+			return c.ID
+		}
+	}
+	return s
+}
+
+func (app *App) handleAPIAccounts(w http.ResponseWriter, r *http.Request) error {
+	data, err := app.loadData(r.Context(), r.FormValue("mock"))
+	if err != nil {
+		return err
+	}
+	accounts := make([]*v1Account, 0, len(data.Accounts))
+	for _, a := range data.Accounts {
+		acc := &v1Account{ID: a.ID, Name: a.Name}
+		if !slices.Contains(app.HideBalance, a.Name) {
+			acc.Balance = &a.Balance
+		}
+		accounts = append(accounts, acc)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"accounts": accounts})
+	return nil
+}
+
+func (app *App) handleAPICategories(w http.ResponseWriter, r *http.Request) error {
+	data, err := app.loadData(r.Context(), r.FormValue("mock"))
+	if err != nil {
+		return err
+	}
+	categories := make([]*v1Category, 0, len(data.AllCategories))
+	for _, c := range data.AllCategories {
+		cat := &v1Category{ID: c.ID, Name: c.Name}
+		if c.IsTransferCategory() {
+			cat.TransferAccountID = c.TransferTargetID()
+		}
+		categories = append(categories, cat)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"categories": categories})
+	return nil
+}
+
+func (app *App) handleAPICurrencies(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	currencies := make([]*v1Currency, 0, len(app.Currencies))
+	for _, c := range app.Currencies {
+		currencies = append(currencies, &v1Currency{
+			Code:     c.Code,
+			Rate:     app.Rate(c, now),
+			Decimals: c.Decimals,
+			Default:  c == app.DefaultCurrency,
+			Budget:   c == app.BudgetCurrency,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"currencies": currencies})
+	return nil
+}
+
+// handleAPITransactions lists transactions newest first, optionally only
+// those since and until the given dates, of an account or a category
+func (app *App) handleAPITransactions(w http.ResponseWriter, r *http.Request) error {
+	since, until := r.FormValue("since"), r.FormValue("until")
+	for _, d := range []string{since, until} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return &apiError{Status: http.StatusBadRequest, Code: "invalid_query", Message: "Dates must look like 2025-01-31."}
+		}
+	}
+	limit := defaultAPITxLimit
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAPITxLimit {
+			return &apiError{Status: http.StatusBadRequest, Code: "invalid_query", Message: fmt.Sprintf("The limit must be between 1 and %d.", maxAPITxLimit)}
+		}
+		limit = n
+	}
+	accountID, categoryID := r.FormValue("account_id"), r.FormValue("category_id")
+
+	data, err := app.loadData(r.Context(), r.FormValue("mock"))
+	if err != nil {
+		return err
+	}
+	var txs []*YNABTransaction
+	for _, tx := range slices.Backward(data.Transactions) {
+		if len(txs) == limit {
+			break
+		}
+		if (since != "" && tx.Date < since) || (until != "" && tx.Date > until) ||
+			(accountID != "" && tx.Account.ID != accountID) || (categoryID != "" && !hasCategory(tx, categoryID)) {
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	receipts := app.receiptsOf(txs...)
+	result := make([]*v1Transaction, 0, len(txs))
+	for _, tx := range txs {
+		result = append(result, app.v1Transaction(r, tx, receipts[tx.ID]))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"transactions": result})
+	return nil
+}
+
+func (app *App) handleAPICreateTransaction(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+	r.Form, err = app.decodeTransactionInput(w, r, data)
+	if err != nil {
+		return err
+	}
+	tx, err := app.parseExpenseForm(data, r.Form)
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "enter", Outcome: auditInvalid, Error: verr.Error()})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	result, err := app.enterTransaction(r, data, tx, mock)
+	if err != nil {
+		return err
+	}
+	switch {
+	case result.Duplicate != nil:
+		return &apiError{
+			Status:      http.StatusConflict,
+			Code:        "duplicate",
+			Message:     "A similar transaction is already entered, send allow_duplicate to enter this one anyway.",
+			Transaction: app.v1Transaction(r, result.Duplicate, nil),
+		}
+	case result.Replayed:
+		// Entered by an earlier request with the same token
+		body := map[string]any{"replayed": true}
+		if existing := data.TransactionByID(result.TxID); existing != nil {
+			body["transaction"] = app.v1Transaction(r, existing, app.receiptsOf(existing)[existing.ID])
+		}
+		writeJSON(w, http.StatusOK, body)
+	default:
+		writeJSON(w, http.StatusCreated, map[string]any{"transaction": app.v1Transaction(r, tx, nil)})
+	}
+	return nil
+}
+
+func (app *App) handleAPIUpdateTransaction(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+	old, err := apiTransactionByID(data, r.PathValue("id"))
+	if err != nil {
+		return err
+	} else if old.IsSplit() {
+		return &apiError{Status: http.StatusConflict, Code: "split", Message: "Split transactions cannot be edited, delete and enter it again instead."}
+	}
+	r.Form, err = app.decodeTransactionInput(w, r, data)
+	if err != nil {
+		return err
+	}
+	// Receipts are only attached through the form, keep them
+	receipts := app.receiptsOf(old)[old.ID]
+	r.Form["receipt_name"] = receipts
+
+	tx, err := app.parseExpenseForm(data, r.Form)
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "update", Outcome: auditInvalid, TransactionID: old.ID, Error: verr.Error()})
+		return err
+	} else if err != nil {
+		return err
+	}
+	if err := app.updateTransaction(r, data, old, tx, mock); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"transaction": app.v1Transaction(r, tx, receipts)})
+	return nil
+}
+
+func (app *App) handleAPIDeleteTransaction(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+	tx, err := apiTransactionByID(data, r.PathValue("id"))
+	if err != nil {
+		return err
+	}
+	if err := app.deleteTransaction(r, data, tx, mock); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// hasCategory reports whether the transaction or one of its parts is in the category
+func hasCategory(tx *YNABTransaction, categoryID string) bool {
+	if tx.Category != nil && tx.Category.ID == categoryID {
+		return true
+	}
+	return slices.ContainsFunc(tx.Subtransactions, func(sub *YNABSubtransaction) bool {
+		return sub.Category != nil && sub.Category.ID == categoryID
+	})
+}
+
+func apiTransactionByID(data *YNABData, id string) (*YNABTransaction, error) {
+	tx := data.TransactionByID(id)
+	if tx == nil {
+		return nil, &apiError{Status: http.StatusNotFound, Code: "not_found", Message: "No such transaction."}
+	}
+	return tx, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testAPIToken = "test-api-token"
+
+func newAPITestServer(t *testing.T) http.Handler {
+	_, cfg := newSeededFakeYNAB(t)
+	cfg.Currencies = []CurrencyConfig{
+		{Code: "USD", Rate: 1.0, Format: "$9.99"},
+		{Code: "GEL", Rate: 2.5, Format: "₾9.99"},
+	}
+	cfg.BudgetCurrency = "USD"
+	cfg.DefaultCurrency = "GEL"
+	sum := sha256.Sum256([]byte(testAPIToken))
+	cfg.APITokens = []APITokenConfig{{Name: "script", TokenHash: hex.EncodeToString(sum[:])}}
+
+	apps, err := newAppSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentApps.Store(apps)
+	clearCache()
+	t.Cleanup(clearCache)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	return mux
+}
+
+// callAPI sends the JSON body, if any, and decodes the JSON response into out
+func callAPI(t *testing.T, h http.Handler, method, path, token, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if out != nil {
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Fatalf("%s %s: Content-Type %q, body %s", method, path, ct, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+type apiErrorResponse struct {
+	Error *apiError `json:"error"`
+}
+
+func TestAPI_auth(t *testing.T) {
+	h := newAPITestServer(t)
+	for _, token := range []string{"", "wrong-token"} {
+		var resp apiErrorResponse
+		if code := callAPI(t, h, http.MethodGet, "/api/v1/accounts", token, "", &resp); code != http.StatusUnauthorized || resp.Error.Code != "unauthorized" {
+			t.Errorf("token %q: got %d %+v", token, code, resp.Error)
+		}
+	}
+	var resp apiErrorResponse
+	if code := callAPI(t, h, http.MethodGet, "/p/nope/api/v1/accounts", testAPIToken, "", &resp); code != http.StatusNotFound || resp.Error.Code != "not_found" {
+		t.Errorf("unknown profile: got %d %+v", code, resp.Error)
+	}
+}
+
+func TestAPI_lists(t *testing.T) {
+	h := newAPITestServer(t)
+
+	var accounts struct{ Accounts []*v1Account }
+	if code := callAPI(t, h, http.MethodGet, "/api/v1/accounts", testAPIToken, "", &accounts); code != http.StatusOK {
+		t.Fatalf("accounts: %d", code)
+	}
+	if len(accounts.Accounts) != 2 || accounts.Accounts[0].Name != "Cash" || accounts.Accounts[0].Balance == nil {
+		t.Errorf("accounts = %+v", accounts.Accounts)
+	}
+
+	var categories struct{ Categories []*v1Category }
+	callAPI(t, h, http.MethodGet, "/api/v1/categories", testAPIToken, "", &categories)
+	var names []string
+	for _, c := range categories.Categories {
+		names = append(names, c.Name)
+	}
+	if !strings.Contains(strings.Join(names, ","), "Groceries,Dining Out") {
+		t.Errorf("categories = %v", names)
+	}
+
+	var currencies struct{ Currencies []*v1Currency }
+	callAPI(t, h, http.MethodGet, "/api/v1/currencies", testAPIToken, "", &currencies)
+	i := slices.IndexFunc(currencies.Currencies, func(c *v1Currency) bool { return c.Code == "GEL" })
+	if len(currencies.Currencies) != 2 || i < 0 || *currencies.Currencies[i] != (v1Currency{Code: "GEL", Rate: 2.5, Decimals: 2, Default: true}) {
+		t.Errorf("currencies = %+v", currencies.Currencies)
+	}
+}
+
+func TestAPI_transactions(t *testing.T) {
+	h := newAPITestServer(t)
+
+	type txResponse struct {
+		Transaction *v1Transaction
+		Replayed    bool
+	}
+	body := `{"amount": 25, "currency": "GEL", "account": "cash", "category": "Dining Out", "comment": "Cat litter", "token": "abc123"}`
+	var created txResponse
+	if code := callAPI(t, h, http.MethodPost, "/api/v1/transactions", testAPIToken, body, &created); code != http.StatusCreated {
+		t.Fatalf("create: %d", code)
+	}
+	tx := created.Transaction
+	if tx.ID == "" || tx.Amount != -10_000 || tx.AccountID != "A1" || tx.CategoryID != "C2" || tx.Memo != "₾25 @2.5 Cat litter [script]" {
+		t.Errorf("created = %+v", tx)
+	}
+
+	var replayed txResponse
+	if code := callAPI(t, h, http.MethodPost, "/api/v1/transactions", testAPIToken, body, &replayed); code != http.StatusOK || !replayed.Replayed || replayed.Transaction.ID != tx.ID {
+		t.Errorf("retry: %d %+v", code, replayed)
+	}
+
+	var resp apiErrorResponse
+	body = `{"amount": 25, "currency": "GEL", "account": "A1", "category": "C2"}`
+	if code := callAPI(t, h, http.MethodPost, "/api/v1/transactions", testAPIToken, body, &resp); code != http.StatusConflict || resp.Error.Code != "duplicate" || resp.Error.Transaction.ID != tx.ID {
+		t.Errorf("duplicate: %d %+v", code, resp.Error)
+	}
+	resp = apiErrorResponse{}
+	body = `{"amount": "x", "account": "A1"}`
+	if code := callAPI(t, h, http.MethodPost, "/api/v1/transactions", testAPIToken, body, &resp); code != http.StatusUnprocessableEntity ||
+		resp.Error.Code != "invalid" || resp.Error.Fields["amount"] == "" || resp.Error.Fields["category"] == "" {
+		t.Errorf("invalid: %d %+v", code, resp.Error)
+	}
+	resp = apiErrorResponse{}
+	if code := callAPI(t, h, http.MethodPost, "/api/v1/transactions", testAPIToken, `{"amont": 1}`, &resp); code != http.StatusBadRequest || resp.Error.Code != "invalid_json" {
+		t.Errorf("bad JSON: %d %+v", code, resp.Error)
+	}
+
+	var updated txResponse
+	body = `{"amount": "12,5", "currency": "USD", "account": "A1", "category": "C1", "comment": "Cat food"}`
+	if code := callAPI(t, h, http.MethodPut, "/api/v1/transactions/"+tx.ID, testAPIToken, body, &updated); code != http.StatusOK {
+		t.Fatalf("update: %d", code)
+	}
+	if updated.Transaction.Amount != -12_500 || updated.Transaction.Memo != "Cat food [script]" {
+		t.Errorf("updated = %+v", updated.Transaction)
+	}
+
+	var list struct{ Transactions []*v1Transaction }
+	callAPI(t, h, http.MethodGet, "/api/v1/transactions?category_id=C1&since=2020-01-01&limit=1", testAPIToken, "", &list)
+	if len(list.Transactions) != 1 || list.Transactions[0].ID != tx.ID {
+		t.Errorf("filtered = %+v", list.Transactions)
+	}
+	resp = apiErrorResponse{}
+	if code := callAPI(t, h, http.MethodGet, "/api/v1/transactions?since=yesterday", testAPIToken, "", &resp); code != http.StatusBadRequest || resp.Error.Code != "invalid_query" {
+		t.Errorf("bad filter: %d %+v", code, resp.Error)
+	}
+
+	if code := callAPI(t, h, http.MethodDelete, "/api/v1/transactions/"+tx.ID, testAPIToken, "", nil); code != http.StatusNoContent {
+		t.Errorf("delete: %d", code)
+	}
+	resp = apiErrorResponse{}
+	if code := callAPI(t, h, http.MethodDelete, "/api/v1/transactions/"+tx.ID, testAPIToken, "", &resp); code != http.StatusNotFound || resp.Error.Code != "not_found" {
+		t.Errorf("delete again: %d %+v", code, resp.Error)
+	}
+}
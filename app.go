@@ -1,24 +1,40 @@
 package main
 
-import "fmt"
+import (
+	"cmp"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 type App struct {
+	Config            *AppConfig
+	Profile           string // name of the profile, empty for the default one
+	BasePath          string // URL prefix of the profile's pages, like /p/pets
 	Currencies        []*Currency
 	CurrenciesByCode  map[string]*Currency
 	DefaultCurrency   *Currency
 	BudgetCurrency    *Currency
 	SecondaryCurrency *Currency
 	HideBalance       []string
+	Rates             *RateStore
+	Audit             *AuditLog     // nil if not enabled
+	Receipts          *ReceiptStore // nil if not enabled
+	RefreshInterval   time.Duration // 0 if background refreshes are off
+	RefreshJitter     time.Duration
 }
 
 func New(cfg *AppConfig) (*App, error) {
 	currencies := make([]*Currency, 0)
 	for _, c := range cfg.Currencies {
-		currencies = append(currencies, &Currency{
-			Code:   c.Code,
-			Rate:   c.Rate,
-			Format: c.Format,
-		})
+		currency, err := newCurrency(c)
+		if err != nil {
+			return nil, fmt.Errorf("currency %s: %w", c.Code, err)
+		}
+		currencies = append(currencies, currency)
 	}
 
 	currenciesByCode := make(map[string]*Currency, len(cfg.Currencies))
@@ -53,32 +69,171 @@ func New(cfg *AppConfig) (*App, error) {
 		orderedCurrencies = append(orderedCurrencies, c)
 	}
 
+	if m := cfg.BudgetMatch; m != "" && m != budgetMatchExact && m != budgetMatchLoose {
+		return nil, fmt.Errorf("budget_match must be %s or %s, got %q", budgetMatchExact, budgetMatchLoose, m)
+	}
+
+	for _, p := range cfg.Presets {
+		if err := checkPreset(p, currenciesByCode[cmp.Or(p.Currency, cfg.DefaultCurrency)]); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", p.Name, err)
+		}
+	}
+
+	refreshInterval, err := parseConfigDuration(cfg.RefreshInterval, cacheDuration)
+	if err != nil {
+		return nil, fmt.Errorf("refresh interval: %w", err)
+	}
+	refreshJitter, err := parseConfigDuration(cfg.RefreshJitter, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("refresh jitter: %w", err)
+	}
+
+	rates := NewRateStore()
+	if cfg.RatesFile != "" {
+		if err := rates.LoadRatesFile(cfg.RatesFile); err != nil {
+			return nil, fmt.Errorf("rates file: %w", err)
+		}
+	}
+	if cfg.ECBRatesFile != "" {
+		if err := rates.LoadECBFile(cfg.ECBRatesFile, budgetCurrency.Code); err != nil {
+			return nil, fmt.Errorf("ECB rates file: %w", err)
+		}
+	}
+
 	return &App{
+		Config:            cfg,
 		Currencies:        orderedCurrencies,
 		CurrenciesByCode:  currenciesByCode,
 		DefaultCurrency:   defaultCurrency,
 		BudgetCurrency:    budgetCurrency,
 		SecondaryCurrency: secondaryCurrency,
 		HideBalance:       cfg.HideBalance,
+		Rates:             rates,
+		Audit:             openAuditLog(cfg.AuditLog),
+		Receipts:          openReceiptStore(cfg.ReceiptsDir),
+		RefreshInterval:   refreshInterval,
+		RefreshJitter:     refreshJitter,
 	}, nil
 }
 
-func (app *App) ConvertAmount(amount Amount, from, to *Currency) Amount {
-	if from == to {
-		return amount
-	} else if from == app.BudgetCurrency {
-		return Amount(float64(amount)*to.Rate + 0.5)
-	} else if to == app.BudgetCurrency {
-		return Amount(float64(amount)/from.Rate + 0.5)
+// parseConfigDuration parses a duration like "5m", returning def if s is
+// empty
+func parseConfigDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative, got %s", s)
+	}
+	return d, nil
+}
+
+// printfVerb matches the number placeholder of formats like "$%0.2f"
+var printfVerb = regexp.MustCompile(`%[-+ #0]*[0-9]*(\.[0-9]+)?[a-z]`)
+
+func newCurrency(c CurrencyConfig) (*Currency, error) {
+	rounding, err := ParseRoundingMode(c.Rounding)
+	if err != nil {
+		return nil, err
+	}
+	if !validRate(c.Rate) {
+		return nil, fmt.Errorf("rate must be a positive number, got %v", c.Rate)
+	}
+	currency := &Currency{
+		Code:             c.Code,
+		Rate:             c.Rate,
+		Decimals:         2,
+		DecimalSeparator: cmp.Or(c.DecimalSeparator, "."),
+		GroupSeparator:   c.GroupSeparator,
+		Rounding:         rounding,
+	}
+	if c.Decimals != nil {
+		currency.Decimals = *c.Decimals
+	}
+	if currency.Decimals < 0 || currency.Decimals > 3 {
+		return nil, fmt.Errorf("decimals must be between 0 and 3, got %d", currency.Decimals)
+	}
+	if currency.DecimalSeparator != "." && currency.DecimalSeparator != "," {
+		return nil, fmt.Errorf("decimal separator must be a dot or a comma, got %q", currency.DecimalSeparator)
+	}
+	if g := currency.GroupSeparator; g != "" && (utf8.RuneCountInString(g) != 1 || !isGroupSeparator([]rune(g)[0]) || g == currency.DecimalSeparator) {
+		return nil, fmt.Errorf("unsupported group separator %q", g)
+	}
+
+	if c.Symbol != "" {
+		space := ""
+		if c.SymbolSpace {
+			space = " "
+		}
+		switch c.SymbolPosition {
+		case "", "before":
+			currency.Prefix = c.Symbol + space
+		case "after":
+			currency.Suffix = space + c.Symbol
+		default:
+			return nil, fmt.Errorf("symbol position must be before or after, got %q", c.SymbolPosition)
+		}
+	} else if prefix, suffix, found := strings.Cut(c.Format, "9.99"); found {
+		currency.Prefix, currency.Suffix = prefix, suffix
+	} else if loc := printfVerb.FindStringIndex(c.Format); loc != nil {
+		currency.Prefix, currency.Suffix = c.Format[:loc[0]], c.Format[loc[1]:]
 	} else {
-		interim := app.ConvertAmount(amount, from, app.BudgetCurrency)
-		return app.ConvertAmount(interim, app.BudgetCurrency, to)
+		currency.Prefix = c.Format
+	}
+	return currency, nil
+}
+
+// Rate returns the exchange rate of the currency (units per one unit of the
+// budget currency) on the given date, falling back to the nearest earlier
+// date with a known rate, and then to the configured rate.
+func (app *App) Rate(c *Currency, date time.Time) float64 {
+	if c == app.BudgetCurrency {
+		return 1
 	}
+	if rate, ok := app.Rates.Lookup(c.Code, date); ok {
+		return rate
+	}
+	return c.Rate
 }
 
-func (app *App) Convert(amount Amount, from, to *Currency) Monetary {
-	return Monetary{
-		Amount:   app.ConvertAmount(amount, from, to),
-		Currency: to,
+// ConvertAmount converts the amount at the rates of the given date, rounding
+// to milliunits as configured for the target currency.
+func (app *App) ConvertAmount(amount Amount, from, to *Currency, date time.Time) (Amount, error) {
+	if from == to {
+		return amount, nil
+	}
+	exact, err := app.convertExact(amount, from, to, date)
+	if err != nil {
+		return 0, err
 	}
+	return roundRat(exact, 1, to.Rounding), nil
+}
+
+// convertExact returns the converted amount in milliunits without rounding.
+func (app *App) convertExact(amount Amount, from, to *Currency, date time.Time) (*big.Rat, error) {
+	r := new(big.Rat).SetInt64(int64(amount))
+	if to != app.BudgetCurrency {
+		rate, err := ratFromFloat(app.Rate(to, date))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", to.Code, err)
+		}
+		r.Mul(r, rate)
+	}
+	if from != app.BudgetCurrency {
+		rate, err := ratFromFloat(app.Rate(from, date))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", from.Code, err)
+		}
+		r.Quo(r, rate)
+	}
+	return r, nil
+}
+
+func (app *App) Convert(amount Amount, from, to *Currency, date time.Time) (Monetary, error) {
+	converted, err := app.ConvertAmount(amount, from, to, date)
+	return Monetary{Amount: converted, Currency: to}, err
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Assets that aren't ours are committed with the rest, so that the binary
+// serves everything itself: Turbo 8.0.12, the es2017 UMD build, in
+// static/vendor, and Open Sans in static/fonts.
+
+// staticAsset is a file under static/, served both under its own name and
+// under a name with a hash of its content, which never changes and so can
+// be cached forever
+type staticAsset struct {
+	Name       string // e.g. app.js
+	HashedName string // e.g. app.1f2e3d4c.js
+	ETag       string
+	Content    []byte
+}
+
+// staticAssets indexes staticFS by both names
+type staticAssets struct {
+	byName       map[string]*staticAsset
+	byHashedName map[string]*staticAsset
+}
+
+var assets = mustLoadAssets(staticFS, "static")
+
+func mustLoadAssets(fsys fs.FS, dir string) *staticAssets {
+	a := &staticAssets{
+		byName:       make(map[string]*staticAsset),
+		byHashedName: make(map[string]*staticAsset),
+	}
+	err := fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:4])
+		name := strings.TrimPrefix(p, dir+"/")
+		ext := path.Ext(name)
+		asset := &staticAsset{
+			Name:       name,
+			HashedName: strings.TrimSuffix(name, ext) + "." + hash + ext,
+			ETag:       `"` + hex.EncodeToString(sum[:16]) + `"`,
+			Content:    content,
+		}
+		a.byName[asset.Name] = asset
+		a.byHashedName[asset.HashedName] = asset
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("** static assets: %v", err)
+	}
+	return a
+}
+
+// URL returns the hashed path of the named asset, or an empty string if
+// there's no such asset
+func (a *staticAssets) URL(name string) string {
+	if asset := a.byName[name]; asset != nil {
+		return "/static/" + asset.HashedName
+	}
+	return ""
+}
+
+// handleStatic serves the assets. Hashed names are cached for a year; plain
+// names, which pages don't use but the service worker and old cached pages
+// may, are revalidated with the ETag every time.
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	asset := assets.byHashedName[name]
+	if asset != nil {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if asset = assets.byName[name]; asset != nil {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", asset.ETag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, asset.Name, time.Time{}, bytes.NewReader(asset.Content))
+}
+
+// contentSecurityPolicy allows only our own scripts, styles, images and
+// connections. Inline styles need the nonce; Turbo adds its progress bar
+// style with the one it finds in the csp-nonce meta tag.
+func contentSecurityPolicy(nonce string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self'",
+		"style-src 'self' 'nonce-" + nonce + "'",
+		"img-src 'self' data:",
+		"font-src 'self'",
+		"connect-src 'self'",
+		"manifest-src 'self'",
+		"worker-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
+
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
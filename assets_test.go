@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStaticAssets(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /static/{name...}", handleStatic)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	url := assets.URL("app.css")
+	if url == "/static/app.css" || !strings.HasPrefix(url, "/static/app.") || !strings.HasSuffix(url, ".css") {
+		t.Fatalf("URL(app.css) = %q", url)
+	}
+	w := get(url, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("GET %s: %d %v", url, w.Code, w.Header())
+	}
+	etag := w.Header().Get("ETag")
+	if w := get(url, etag); w.Code != http.StatusNotModified {
+		t.Errorf("GET %s with its ETag: %d", url, w.Code)
+	}
+
+	if w := get("/static/queue.js", ""); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("GET /static/queue.js: %d %v", w.Code, w.Header())
+	}
+	if w := get("/static/app.00000000.css", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET with a wrong hash: %d", w.Code)
+	}
+	if url := assets.URL("missing.js"); url != "" {
+		t.Errorf("URL(missing.js) = %q", url)
+	}
+}
+
+func TestVendoredAssets(t *testing.T) {
+	for _, name := range []string{"vendor/turbo.min.js", "fonts/open-sans-400.woff2", "fonts/open-sans-600.woff2"} {
+		if assets.URL(name) == "" {
+			t.Errorf("static/%s is missing", name)
+		}
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	app := newFakeYNABApp(t)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	if err := app.handleIndex(w, req); err != nil {
+		t.Fatal(err)
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "script-src 'self'") {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "https://") {
+		t.Errorf("Expected the page to load nothing from other sites")
+	}
+	if !strings.Contains(body, `href="`+assets.URL("app.css")+`"`) || !strings.Contains(body, `src="`+assets.URL("app.js")+`"`) {
+		t.Errorf("Expected the page to use hashed asset names")
+	}
+	nonce := csp[strings.Index(csp, "'nonce-")+len("'nonce-"):]
+	nonce = nonce[:strings.Index(nonce, "'")]
+	if !strings.Contains(body, `<meta name="csp-nonce" content="`+nonce+`"`) {
+		t.Errorf("Expected the nonce %q in the page", nonce)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time     time.Time  `json:"time"`
+	Action   string     `json:"action"`  // enter, update, delete or sync
+	Outcome  string     `json:"outcome"` // see the audit* constants
+	Profile  string     `json:"profile,omitempty"`
+	User     string     `json:"user,omitempty"`
+	RemoteIP string     `json:"remote_ip,omitempty"`
+	Form     url.Values `json:"form,omitempty"`
+
+	// The transaction as sent to YNAB
+	Currency      string  `json:"currency,omitempty"` // as entered
+	Rate          float64 `json:"rate,omitempty"`     // units of Currency per budget currency unit
+	Amount        Amount  `json:"amount,omitempty"`   // in budget currency, negative for outflows
+	TransactionID string  `json:"transaction_id,omitempty"`
+
+	// Synced transactions, listed for incremental syncs only
+	Changed []string `json:"changed,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	auditOK        = "ok"
+	auditInvalid   = "invalid"   // form validation failed
+	auditDuplicate = "duplicate" // similar transaction exists, confirmation asked
+	auditReplay    = "replay"    // resubmitted form, transaction already created
+	auditError     = "error"
+)
+
+// AuditLog appends entries to a JSON Lines file
+type AuditLog struct {
+	path string
+	mut  sync.Mutex
+}
+
+var (
+	auditLogs    = make(map[string]*AuditLog) // by path, shared between profiles
+	auditLogsMut sync.Mutex
+)
+
+// openAuditLog returns the audit log stored at the path, or nil if the path
+// is empty.
+func openAuditLog(path string) *AuditLog {
+	if path == "" {
+		return nil
+	}
+	auditLogsMut.Lock()
+	defer auditLogsMut.Unlock()
+	l := auditLogs[path]
+	if l == nil {
+		l = &AuditLog{path: path}
+		auditLogs[path] = l
+	}
+	return l
+}
+
+func (l *AuditLog) Append(e *AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Entries returns the logged entries matching the filter, newest first, at
+// most limit of them.
+func (l *AuditLog) Entries(filter func(e *AuditEntry) bool, limit int) ([]*AuditEntry, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, err := os.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue // a line cut short by a crash
+		}
+		if filter(e) {
+			result = append(result, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// audit records an action taken on a request, filling in who and from where
+func (app *App) audit(r *http.Request, e *AuditEntry) {
+	if app.Audit == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Profile = app.Profile
+	if u := userFrom(r.Context()); u != nil {
+		e.User = u.Name
+	}
+	e.RemoteIP = remoteIP(r)
+	e.Form = r.Form
+	if err := app.Audit.Append(e); err != nil {
+		log.Printf("WARNING: audit log: %v", err)
+	}
+}
+
+// auditTransaction returns an entry describing the transaction sent to YNAB
+func (app *App) auditTransaction(action string, r *http.Request, tx *YNABTransaction) *AuditEntry {
+	e := &AuditEntry{
+		Action:   action,
+		Currency: r.Form.Get("currency"),
+	}
+	if tx != nil {
+		e.Amount = tx.Amount
+		e.TransactionID = tx.ID
+		if c := app.CurrenciesByCode[e.Currency]; c != nil {
+			date, _ := time.Parse("2006-01-02", tx.Date)
+			e.Rate = app.Rate(c, date)
+		}
+	}
+	return e
+}
+
+// auditSync records a load of YNAB data, listing the transactions changed
+// since the previous one.
+func (app *App) auditSync(prev, data *YNABData) {
+	if app.Audit == nil {
+		return
+	}
+	e := &AuditEntry{
+		Time:    time.Now(),
+		Action:  "sync",
+		Outcome: auditOK,
+		Profile: app.Profile,
+	}
+	if prev != nil && prev.Sync != nil && data.Sync != nil {
+		e.Changed, e.Removed = changedTransactions(prev.Sync, data.Sync)
+		if len(e.Changed) == 0 && len(e.Removed) == 0 {
+			return
+		}
+	}
+	if err := app.Audit.Append(e); err != nil {
+		log.Printf("WARNING: audit log: %v", err)
+	}
+}
+
+// remoteIP returns the client address, taking the one added by a reverse
+// proxy on the same host into account.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
+
+type auditPageData struct {
+	Entries  []*AuditEntry
+	Filter   url.Values
+	Users    []string
+	BasePath string
+	Budget   *Currency
+}
+
+const maxAuditEntries = 500
+
+func (app *App) handleAudit(w http.ResponseWriter, r *http.Request) error {
+	if app.Audit == nil {
+		http.Error(w, "The audit log is not enabled, set audit_log in the config.", http.StatusNotFound)
+		return nil
+	}
+
+	u := userFrom(r.Context())
+	user, action, outcome := r.FormValue("user"), r.FormValue("action"), r.FormValue("outcome")
+	q := strings.ToLower(r.FormValue("q"))
+	users := make(map[string]bool)
+	entries, err := app.Audit.Entries(func(e *AuditEntry) bool {
+		if e.Profile != app.Profile {
+			return false
+		}
+		// Users limited to some accounts or categories only see their own entries
+		if u != nil && (len(u.Accounts) > 0 || len(u.Categories) > 0) && e.User != u.Name {
+			return false
+		}
+		if e.User != "" {
+			users[e.User] = true
+		}
+		return (user == "" || e.User == user) &&
+			(action == "" || e.Action == action) &&
+			(outcome == "" || e.Outcome == outcome) &&
+			(q == "" || strings.Contains(strings.ToLower(auditSearchText(e)), q))
+	}, maxAuditEntries)
+	if err != nil {
+		return err
+	}
+
+	return app.renderPage(w, http.StatusOK, "audit.html", &auditPageData{
+		Entries:  entries,
+		Filter:   r.Form,
+		Users:    slices.Sorted(maps.Keys(users)),
+		BasePath: app.BasePath,
+		Budget:   app.BudgetCurrency,
+	})
+}
+
+// auditSearchText is what the q filter of the audit page looks at
+func auditSearchText(e *AuditEntry) string {
+	var parts []string
+	for _, values := range e.Form {
+		parts = append(parts, values...)
+	}
+	return strings.Join(append(parts, e.TransactionID, e.Error, e.RemoteIP), " ")
+}
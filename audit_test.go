@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.Audit = openAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	w := postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+		"date":     {"2025-02-01"},
+		"amount":   {"25"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C2"},
+		"comment":  {"Cat litter"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+	w = postForm(t, app.handleEnterExpense, "/enter", "", url.Values{"amount": {"x"}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d", w.Code)
+	}
+	app.cache().expire()
+	getPage(t, app.handleIndex, "/", "")
+
+	all := func(e *AuditEntry) bool { return true }
+	entries, err := app.Audit.Entries(all, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action+":"+e.Outcome)
+	}
+	// Newest first: the delta sync, the invalid form, the entry and the initial full load
+	if strings.Join(actions, " ") != "sync:ok enter:invalid enter:ok sync:ok" {
+		t.Fatalf("audit entries = %v", actions)
+	}
+
+	sync, invalid, entered := entries[0], entries[1], entries[2]
+	if entered.TransactionID == "" || entered.Amount != -10_000 || entered.Rate != 2.5 || entered.Currency != "GEL" ||
+		entered.Form.Get("comment") != "Cat litter" || entered.RemoteIP != "192.0.2.1" {
+		t.Errorf("entered = %+v", entered)
+	}
+	if !strings.Contains(invalid.Error, "amount") {
+		t.Errorf("invalid = %+v", invalid)
+	}
+	if !slices.Contains(sync.Changed, entered.TransactionID) {
+		t.Errorf("delta sync changed = %v, wanted %s", sync.Changed, entered.TransactionID)
+	}
+
+	body := getPage(t, app.handleAudit, "/audit?q=litter", "")
+	if !strings.Contains(body, entered.TransactionID) || strings.Contains(body, "Enter a number") {
+		t.Errorf("audit page filtered by q doesn't show just the entry")
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	curl := `curl -H 'Authorization: Bearer secret-token' https://api.ynab.com/v1/budgets`
+	if s := redactToken(curl, "secret-token"); strings.Contains(s, "secret-token") {
+		t.Errorf("token not redacted: %s", s)
+	}
+}
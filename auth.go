@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionDuration   = 30 * 24 * time.Hour
+
+	// defaultProfileName refers to the top-level form in UserConfig.Profiles
+	defaultProfileName = "default"
+)
+
+// User is someone allowed to log in, see UserConfig
+type User struct {
+	Name         string
+	PasswordHash []byte
+	Profiles     []string // empty means all
+	Accounts     []string // empty means all of the profile's
+	Categories   []string // empty means all of the profile's
+}
+
+// authenticator checks logins and session cookies. There is none when the
+// config lists no users, leaving authentication to a reverse proxy.
+type authenticator struct {
+	Users map[string]*User
+	Key   []byte // signs session cookies
+}
+
+// processSessionKey signs session cookies when the config has no
+// session_secret, so logins survive config reloads but not restarts.
+var processSessionKey = func() []byte {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return b[:]
+}()
+
+// dummyPasswordHash keeps failed logins of unknown users as slow as others
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func newAuthenticator(cfg *AppConfig) (*authenticator, error) {
+	if len(cfg.Users) == 0 {
+		return nil, nil
+	}
+	auth := &authenticator{
+		Users: make(map[string]*User, len(cfg.Users)),
+		Key:   processSessionKey,
+	}
+	if cfg.SessionSecret != "" {
+		auth.Key = []byte(cfg.SessionSecret)
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" || auth.Users[u.Name] != nil {
+			return nil, fmt.Errorf("user names must be unique and non-empty, got %q", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user %s: password_hash must be a bcrypt hash: %w", u.Name, err)
+		}
+		for _, p := range u.Profiles {
+			if _, found := cfg.Profiles[p]; !found && p != defaultProfileName {
+				return nil, fmt.Errorf("user %s: unknown profile %q", u.Name, p)
+			}
+		}
+		auth.Users[u.Name] = &User{
+			Name:         u.Name,
+			PasswordHash: []byte(u.PasswordHash),
+			Profiles:     u.Profiles,
+			Accounts:     u.Accounts,
+			Categories:   u.Categories,
+		}
+	}
+	return auth, nil
+}
+
+// login returns the user if the password is right
+func (a *authenticator) login(name, password string) *User {
+	u := a.Users[name]
+	if u == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return nil
+	}
+	return u
+}
+
+// sessionCookie returns a cookie like "name.expiry.signature". The signature
+// covers the password hash, so changing a password ends existing sessions.
+func (a *authenticator) sessionCookie(r *http.Request, u *User) *http.Cookie {
+	expires := time.Now().Add(sessionDuration)
+	value := base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value + "." + a.sign(u, value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (a *authenticator) sign(u *User, value string) string {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(value))
+	mac.Write(u.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userFromRequest returns the user of a valid session cookie, if any
+func (a *authenticator) userFromRequest(r *http.Request) *User {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	name64, rest, _ := strings.Cut(c.Value, ".")
+	expiry, sig, _ := strings.Cut(rest, ".")
+	name, err := base64.RawURLEncoding.DecodeString(name64)
+	if err != nil {
+		return nil
+	}
+	u := a.Users[string(name)]
+	if u == nil {
+		return nil
+	}
+	if exp, err := strconv.ParseInt(expiry, 10, 64); err != nil || time.Now().Unix() > exp {
+		return nil
+	}
+	if !hmac.Equal([]byte(sig), []byte(a.sign(u, name64+"."+expiry))) {
+		return nil
+	}
+	return u
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (u *User) canUseProfile(profile string) bool {
+	if profile == "" {
+		profile = defaultProfileName
+	}
+	return len(u.Profiles) == 0 || slices.Contains(u.Profiles, profile)
+}
+
+func (u *User) canUseAccount(name string) bool {
+	return len(u.Accounts) == 0 || slices.Contains(u.Accounts, name)
+}
+
+func (u *User) canUseCategory(name string) bool {
+	return len(u.Categories) == 0 || slices.Contains(u.Categories, name)
+}
+
+// visibleData returns the accounts, categories and transactions of the data
+// that the user is allowed to see and use. A nil user sees everything.
+func (u *User) visibleData(data *YNABData) *YNABData {
+	if u == nil || (len(u.Accounts) == 0 && len(u.Categories) == 0) {
+		return data
+	}
+	result := *data
+	result.Accounts = slices.DeleteFunc(slices.Clone(data.Accounts), func(a *YNABAccount) bool {
+		return !u.canUseAccount(a.Name)
+	})
+	result.Categories = slices.DeleteFunc(slices.Clone(data.Categories), func(c *YNABCategory) bool {
+		return !u.canUseCategory(c.Name)
+	})
+	result.AllCategories = slices.DeleteFunc(slices.Clone(data.AllCategories), func(c *YNABCategory) bool {
+		if c.IsTransferCategory() {
+			return result.AccountByID(c.TransferTargetID()) == nil
+		}
+		return !u.canUseCategory(c.Name)
+	})
+	result.Transactions = slices.DeleteFunc(slices.Clone(data.Transactions), func(tx *YNABTransaction) bool {
+		if result.AccountByID(tx.Account.ID) == nil {
+			return true
+		}
+		if tx.IsSplit() {
+			for _, sub := range tx.Subtransactions {
+				if sub.Category == nil || !u.canUseCategory(sub.Category.Name) {
+					return true
+				}
+			}
+			return false
+		}
+		return result.CategoryByID(tx.Category.ID) == nil
+	})
+	return &result
+}
+
+type userContextKey struct{}
+
+func withUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, u)
+}
+
+// userFrom returns the logged-in user, or nil when authentication is off
+func userFrom(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey{}).(*User)
+	return u
+}
+
+// withAuthor appends the user's name to a memo, like "Cat litter [Alice]"
+func withAuthor(comment string, u *User) string {
+	if u == nil {
+		return comment
+	}
+	if comment == "" {
+		return "[" + u.Name + "]"
+	}
+	return comment + " [" + u.Name + "]"
+}
+
+// withoutAuthor removes the author suffix added by withAuthor. Only the
+// names of configured users, and of API tokens that act as no user, count,
+// so a memo like "Taxi [airport]" is kept.
+func (app *App) withoutAuthor(comment string) string {
+	names := make([]string, 0, len(app.Config.Users)+len(app.Config.APITokens))
+	for _, u := range app.Config.Users {
+		names = append(names, u.Name)
+	}
+	for _, t := range app.Config.APITokens {
+		if t.User == "" {
+			names = append(names, t.Name)
+		}
+	}
+	for _, name := range names {
+		if rest, ok := strings.CutSuffix(comment, "["+name+"]"); ok {
+			return strings.TrimRight(rest, " ")
+		}
+	}
+	return comment
+}
+
+type loginPageData struct {
+	Name  string
+	Next  string
+	Error string
+}
+
+// localRedirect returns next if it points to a page of this site, and "/"
+// otherwise, so that the login form can't be used to redirect elsewhere.
+// Browsers read a backslash in the path like a slash, so /\evil.com goes
+// to another site as //evil.com does.
+func localRedirect(next string) string {
+	path, _, _ := strings.Cut(next, "?")
+	if u, err := url.Parse(next); err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(path, `\`) {
+		return "/"
+	}
+	return next
+}
+
+func handleLoginPage(w http.ResponseWriter, r *http.Request) error {
+	app := currentApps.Load().Default
+	return app.renderPage(w, http.StatusOK, "login.html", &loginPageData{
+		Next: localRedirect(r.FormValue("next")),
+	})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) error {
+	apps := currentApps.Load()
+	if apps.Auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+	name, next := r.FormValue("name"), localRedirect(r.FormValue("next"))
+	u := apps.Auth.login(name, r.FormValue("password"))
+	if u == nil {
+		log.Printf("Failed login as %q", name)
+		return apps.Default.renderPage(w, http.StatusUnauthorized, "login.html", &loginPageData{
+			Name:  name,
+			Next:  next,
+			Error: "Wrong name or password.",
+		})
+	}
+	http.SetCookie(w, apps.Auth.sessionCookie(r, u))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+	return nil
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newAuthTestServer(t *testing.T, users ...UserConfig) (*FakeYNAB, http.Handler) {
+	fake, cfg := newSeededFakeYNAB(t)
+	cfg.PageTitle = "Test Expenses"
+	cfg.Currencies = []CurrencyConfig{{Code: "USD", Rate: 1.0, Format: "$9.99"}}
+	cfg.BudgetCurrency = "USD"
+	cfg.DefaultCurrency = "USD"
+	cfg.Profiles = map[string]json.RawMessage{"pets": json.RawMessage(`{"page_title": "Pet Expenses"}`)}
+	for i := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(users[i].Name+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[i].PasswordHash = string(hash)
+	}
+	cfg.Users = users
+
+	apps, err := newAppSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentApps.Store(apps)
+	clearCache()
+	t.Cleanup(clearCache)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	return fake, mux
+}
+
+// login returns the session cookie of the user
+func login(t *testing.T, h http.Handler, name string) *http.Cookie {
+	t.Helper()
+	w := serve(h, http.MethodPost, "/login", nil, url.Values{"name": {name}, "password": {name + "-password"}, "next": {"/p/pets/"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/p/pets/" {
+		t.Fatalf("login as %s: status %d, location %q", name, w.Code, w.Header().Get("Location"))
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	t.Fatalf("login as %s: no session cookie", name)
+	return nil
+}
+
+func serve(h http.Handler, method, path string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	_, h := newAuthTestServer(t, UserConfig{Name: "alice"})
+
+	w := serve(h, http.MethodGet, "/p/pets/", nil, nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fp%2Fpets%2F" {
+		t.Fatalf("anonymous: status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = serve(h, http.MethodPost, "/login", nil, url.Values{"name": {"alice"}, "password": {"wrong"}})
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Wrong name or password.") {
+		t.Errorf("wrong password: status %d", w.Code)
+	}
+
+	cookie := login(t, h, "alice")
+	w = serve(h, http.MethodGet, "/p/pets/", cookie, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Logged in as alice") {
+		t.Errorf("logged in: status %d", w.Code)
+	}
+
+	tampered := *cookie
+	tampered.Value = strings.Replace(tampered.Value, ".", "x.", 1)
+	if w := serve(h, http.MethodGet, "/", &tampered, nil); w.Code != http.StatusSeeOther {
+		t.Errorf("tampered cookie: status %d", w.Code)
+	}
+
+	for _, next := range []string{"//evil.example.com/", `/\evil.example.com/`, `/\/evil.example.com/`, "https://evil.example.com/", "evil"} {
+		if got := localRedirect(next); got != "/" {
+			t.Errorf("localRedirect let through %q", got)
+		}
+	}
+	if next := localRedirect(`/p/pets/?q=a\b`); next != `/p/pets/?q=a\b` {
+		t.Errorf("localRedirect(%q) = %q", `/p/pets/?q=a\b`, next)
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	fake, h := newAuthTestServer(t,
+		UserConfig{Name: "sitter", Profiles: []string{"pets"}},
+		UserConfig{Name: "cook", Accounts: []string{"Cash"}, Categories: []string{"Dining Out"}},
+	)
+
+	sitter := login(t, h, "sitter")
+	if w := serve(h, http.MethodGet, "/", sitter, nil); w.Code != http.StatusForbidden {
+		t.Errorf("sitter on the default form: status %d", w.Code)
+	}
+
+	cook := login(t, h, "cook")
+	body := serve(h, http.MethodGet, "/", cook, nil).Body.String()
+	if strings.Contains(body, "Groceries") || strings.Contains(body, "Held By Assistant") || strings.Contains(body, "Sample expense 1") {
+		t.Errorf("cook sees other accounts, categories or their transactions")
+	}
+	if !strings.Contains(body, "Dining Out") || !strings.Contains(body, "Sample expense 2") {
+		t.Errorf("cook doesn't see their own category or transactions")
+	}
+
+	form := url.Values{
+		"date":     {"2025-01-15"},
+		"amount":   {"12"},
+		"currency": {"USD"},
+		"account":  {"A1"},
+		"category": {"C1"},
+		"comment":  {"Not allowed"},
+	}
+	if w := serve(h, http.MethodPost, "/enter", cook, form); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("entering into a forbidden category: status %d", w.Code)
+	}
+
+	form.Set("category", "C2")
+	form.Set("comment", "Lunch")
+	if w := serve(h, http.MethodPost, "/enter", cook, form); w.Code != http.StatusSeeOther {
+		t.Fatalf("entering an expense: status %d", w.Code)
+	}
+	var memo string
+	fake.mu.Lock()
+	for _, tx := range fake.transactions {
+		if tx.Date == "2025-01-15" {
+			memo = tx.Memo
+		}
+	}
+	fake.mu.Unlock()
+	if memo != "Lunch [cook]" {
+		t.Errorf("memo = %q, wanted the author recorded", memo)
+	}
+}
+
+func TestWithoutAuthor(t *testing.T) {
+	app := &App{Config: &AppConfig{
+		Users:     []UserConfig{{Name: "cook"}, {Name: "Pet Sitter"}},
+		APITokens: []APITokenConfig{{Name: "phone"}, {Name: "watch", User: "cook"}},
+	}}
+	tests := map[string]string{
+		"Lunch [cook]":            "Lunch",
+		"[cook]":                  "",
+		"Vet visit [Pet Sitter]":  "Vet visit",
+		"Taxi [airport]":          "Taxi [airport]",
+		"Taxi [airport] [cook]":   "Taxi [airport]",
+		"Lunch [cook] for guests": "Lunch [cook] for guests",
+		"Taxi [phone]":            "Taxi",
+		"Taxi [watch]":            "Taxi [watch]",
+	}
+	for input, want := range tests {
+		if got := app.withoutAuthor(input); got != want {
+			t.Errorf("withoutAuthor(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/andreyvit/mvp/httpcall"
+)
+
+// Special values of budget_id, which YNAB also accepts in place of an ID
+const (
+	lastUsedBudget = "last-used"
+	defaultBudget  = "default" // needs default budget selection enabled for the token
+)
+
+const (
+	budgetMatchExact = "exact"
+	budgetMatchLoose = "loose" // ignoring case, emoji and extra spaces
+)
+
+type apiBudget struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+var (
+	budgetIDs    = make(map[string]string) // by budgetKey
+	budgetIDsMut sync.Mutex
+)
+
+// budgetKey identifies the settings that pick the budget
+func budgetKey(cfg *AppConfig) string {
+	return strings.Join([]string{tokenKey(cfg.YNABToken), cfg.YNABBaseURL, cfg.BudgetID, cfg.BudgetName, cfg.BudgetMatch}, "\x00")
+}
+
+// resolveBudgetID returns the ID of the configured budget, listing the
+// budgets only the first time
+func resolveBudgetID(ctx context.Context, cfg *AppConfig) (string, error) {
+	key := budgetKey(cfg)
+	budgetIDsMut.Lock()
+	id := budgetIDs[key]
+	budgetIDsMut.Unlock()
+	if id != "" {
+		return id, nil
+	}
+
+	id, err := findBudgetID(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	budgetIDsMut.Lock()
+	budgetIDs[key] = id
+	budgetIDsMut.Unlock()
+	return id, nil
+}
+
+// knownBudgetID returns the ID of the configured budget if it's been looked
+// up already, or ""
+func knownBudgetID(cfg *AppConfig) string {
+	budgetIDsMut.Lock()
+	defer budgetIDsMut.Unlock()
+	return budgetIDs[budgetKey(cfg)]
+}
+
+// forgetBudgetID makes the next load look the budget up again, after YNAB
+// said it doesn't know the ID
+func forgetBudgetID(cfg *AppConfig) {
+	budgetIDsMut.Lock()
+	defer budgetIDsMut.Unlock()
+	delete(budgetIDs, budgetKey(cfg))
+}
+
+// findBudgetID picks the budget by budget_id, falling back to matching
+// budget by name
+func findBudgetID(ctx context.Context, cfg *AppConfig) (string, error) {
+	var resp struct {
+		Data struct {
+			Budgets       []*apiBudget `json:"budgets"`
+			DefaultBudget *apiBudget   `json:"default_budget"`
+		} `json:"data"`
+	}
+	req := &httpcall.Request{
+		Context:   ctx,
+		CallID:    "ListBudgets",
+		Method:    http.MethodGet,
+		Path:      "budgets",
+		OutputPtr: &resp,
+	}
+	configureCall(req, cfg)
+	if err := req.Do(); err != nil {
+		return "", err
+	}
+	budgets := resp.Data.Budgets
+
+	var b *apiBudget
+	switch cfg.BudgetID {
+	case "":
+	case lastUsedBudget:
+		var err error
+		if b, err = budgetByAlias(ctx, cfg, lastUsedBudget); err != nil {
+			return "", err
+		}
+	case defaultBudget:
+		b = resp.Data.DefaultBudget
+		if b == nil {
+			return "", fmt.Errorf("YNAB has no default budget for this token")
+		}
+	default:
+		for _, candidate := range budgets {
+			if candidate.ID == cfg.BudgetID {
+				b = candidate
+			}
+		}
+		if b == nil && cfg.BudgetName == "" {
+			return "", fmt.Errorf("budget %s not found in YNAB", cfg.BudgetID)
+		} else if b == nil {
+			log.Printf("WARNING: budget %s not found in YNAB, looking for one named %q", cfg.BudgetID, cfg.BudgetName)
+		}
+	}
+
+	if b == nil {
+		var err error
+		if b, err = budgetByName(budgets, cfg.BudgetName, cfg.BudgetMatch); err != nil {
+			return "", err
+		}
+	} else if cfg.BudgetName != "" && !budgetNameMatches(b.Name, cfg.BudgetName, cfg.BudgetMatch) {
+		log.Printf("WARNING: budget %s is named %q in YNAB, not %q as configured; using it anyway", b.ID, b.Name, cfg.BudgetName)
+	}
+	return b.ID, nil
+}
+
+// budgetByAlias asks YNAB which budget an alias like last-used stands for,
+// which only the budget itself tells. It comes with all of the budget's data,
+// so it's asked once, see resolveBudgetID.
+func budgetByAlias(ctx context.Context, cfg *AppConfig, alias string) (*apiBudget, error) {
+	var resp struct {
+		Data struct {
+			Budget *apiBudget `json:"budget"`
+		} `json:"data"`
+	}
+	req := &httpcall.Request{
+		Context:   ctx,
+		CallID:    "GetBudget",
+		Method:    http.MethodGet,
+		Path:      "budgets/" + alias,
+		OutputPtr: &resp,
+	}
+	configureCall(req, cfg)
+	if err := req.Do(); err != nil {
+		return nil, err
+	}
+	if resp.Data.Budget == nil || resp.Data.Budget.ID == "" {
+		return nil, fmt.Errorf("YNAB didn't say which budget is %s", alias)
+	}
+	return resp.Data.Budget, nil
+}
+
+// budgetByName finds the budget with the given name, preferring an exact
+// match in loose mode
+func budgetByName(budgets []*apiBudget, name, match string) (*apiBudget, error) {
+	for _, b := range budgets {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	var found []*apiBudget
+	for _, b := range budgets {
+		if budgetNameMatches(b.Name, name, match) {
+			found = append(found, b)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("budget named %q not found in YNAB", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%d budgets match the name %q, set budget_id instead", len(found), name)
+	}
+}
+
+func budgetNameMatches(actual, configured, match string) bool {
+	if match == budgetMatchLoose {
+		return looseBudgetName(actual) == looseBudgetName(configured)
+	}
+	return actual == configured
+}
+
+// looseBudgetName lowercases the name and drops emoji and other symbols,
+// with the variation selectors and joiners that go with them, and extra
+// spaces. Other marks are kept, as they tell names apart, like Café and Cafe.
+func looseBudgetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.In(r, unicode.So, unicode.Sk, unicode.Cf, unicode.Variation_Selector) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+	return strings.Join(strings.Fields(name), " ")
+}
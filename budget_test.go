@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFindBudgetID_settings(t *testing.T) {
+	fake, cfg := newSeededFakeYNAB(t)
+	fake.AddBudget("B2", "🏠 Home  Budget")
+	fake.AddBudget("B3", "Old Budget")
+	fake.SetDefaultBudget("B3")
+	fake.SetLastUsedBudget("B2")
+
+	tests := []struct {
+		id, name, match string
+		want            string // empty for an error
+	}{
+		{"", "Family Budget", "", "B1"},
+		{"", "family budget", "", ""},
+		{"", "family budget", "loose", "B1"},
+		{"", "home budget", "loose", "B2"},
+		{"", "🏠 Home  Budget", "", "B2"},
+		{"B3", "", "", "B3"},
+		{"B3", "Family Budget", "", "B3"}, // with a warning about the name
+		{"B9", "Family Budget", "", "B1"}, // falls back to the name
+		{"B9", "", "", ""},
+		{"last-used", "", "", "B2"},
+		{"default", "", "", "B3"},
+	}
+	for _, tt := range tests {
+		c := *cfg
+		c.BudgetID, c.BudgetName, c.BudgetMatch = tt.id, tt.name, tt.match
+		id, err := findBudgetID(context.Background(), &c)
+		if tt.want == "" && err == nil {
+			t.Errorf("findBudgetID(%q, %q, %q) = %q, expected an error", tt.id, tt.name, tt.match, id)
+		} else if tt.want != "" && (err != nil || id != tt.want) {
+			t.Errorf("findBudgetID(%q, %q, %q) = %q, %v; want %q", tt.id, tt.name, tt.match, id, err, tt.want)
+		}
+	}
+
+	fake.SetDefaultBudget("")
+	c := *cfg
+	c.BudgetID = "default"
+	if _, err := findBudgetID(context.Background(), &c); err == nil {
+		t.Errorf("Expected an error without a default budget")
+	}
+}
+
+func TestResolveBudgetID_cached(t *testing.T) {
+	fake, cfg := newSeededFakeYNAB(t)
+	ctx := context.Background()
+	t.Cleanup(func() { forgetBudgetID(cfg) })
+
+	data, err := LoadYNABData(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Requests()
+	if _, err := LoadYNABData(ctx, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fake.Requests() {
+		if r == "GET /v1/budgets" {
+			t.Errorf("Expected the budget ID to be cached")
+		}
+	}
+
+	// Renamed in YNAB, the budget is still found by the cached ID; given a
+	// new ID, it's looked up again
+	fake.RenameBudget("B1", "Renamed Budget")
+	if _, err := LoadYNABData(ctx, cfg, data); err != nil {
+		t.Errorf("Expected the renamed budget to load, got %v", err)
+	}
+	fake.RenameBudget("B7", "Family Budget")
+	data, err = LoadYNABData(ctx, cfg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.BudgetID != "B7" {
+		t.Errorf("Expected the new budget ID, got %q", data.BudgetID)
+	}
+}
+
+func TestLooseBudgetName(t *testing.T) {
+	tests := map[string]string{
+		"Family Budget":       "family budget",
+		"🏠 Family  Budget ✨":  "family budget",
+		"👨‍👩‍👧 Family Budget": "family budget",
+		"Бюджет Семьи":        "бюджет семьи",
+		"Cafe\u0301 Budget":   "cafe\u0301 budget",
+		"हिंदी बजट":           "हिंदी बजट",
+	}
+	for input, want := range tests {
+		if got := looseBudgetName(input); got != want {
+			t.Errorf("looseBudgetName(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
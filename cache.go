@@ -2,60 +2,413 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"maps"
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
 )
 
+// dataCache holds the YNAB data of one profile, saved to cache_dir if set.
+// Stale data is served right away while a single background load refreshes
+// it; only the first load and the one after expire wait for YNAB, and when
+// that fails, the old data is served with a notice rather than an error.
+type dataCache struct {
+	mut      sync.Mutex
+	data     *YNABData
+	cfg      *AppConfig // config the cached data was loaded with
+	ts       time.Time
+	unsynced bool       // the data was read from cache_dir and not synced since
+	expired  bool       // the next load waits for a sync
+	gen      int        // incremented by expire, so loads started earlier don't count
+	inflight *cacheLoad // nil when idle
+	failures int        // loads failed in a row
+	retryAt  time.Time  // no loads until then, after a failure
+	jitter   time.Duration
+	limited  bool  // the data is older than it should be because of the YNAB rate limit
+	loadErr  error // of the last load, if it failed
+}
+
+// cacheLoad is a load from YNAB that any number of callers can wait for
+type cacheLoad struct {
+	cfg  *AppConfig
+	gen  int
+	done chan struct{} // closed when data and err are set
+	data *YNABData
+	err  error
+
+	// redo are the optimistic updates made to the cached data while the
+	// load was running, applied again to its result in case YNAB returned
+	// the data from before them
+	redo []func(data *YNABData)
+}
+
 var (
-	cachedData    *YNABData
-	cachedDataTS  time.Time
-	cachedDataMut sync.Mutex
+	caches    = make(map[string]*dataCache) // by profile name, "" for the default one
+	cachesMut sync.Mutex
 )
 
-const cacheDuration = 5 * time.Minute
-
-func loadYNABDataWithCaching(ctx context.Context, mock string, fresh bool) (*YNABData, error) {
-	cachedDataMut.Lock()
-	defer cachedDataMut.Unlock()
+const (
+	cacheDuration = 5 * time.Minute
+	loadTimeout   = 30 * time.Second
+	minBackoff    = 5 * time.Second
+	maxBackoff    = 5 * time.Minute
+	refreshTick   = 10 * time.Second
+)
 
-	if cachedData != nil && !fresh && time.Since(cachedDataTS) < cacheDuration {
-		return cachedData, nil
+func cacheFor(profile string) *dataCache {
+	cachesMut.Lock()
+	defer cachesMut.Unlock()
+	c := caches[profile]
+	if c == nil {
+		c = &dataCache{}
+		caches[profile] = c
 	}
+	return c
+}
+
+func (app *App) cache() *dataCache {
+	return cacheFor(app.Profile)
+}
+
+// load returns the cached data. Data older than cacheDuration is returned as
+// is and refreshed in the background; with no data, or after expire, load
+// waits for YNAB. If that fails, the data there is comes back anyway, and
+// notice explains why it's old; with no data, the error does, for every
+// call until the backoff ends. onSync, if not nil, is called with the
+// previous and the new data after each load.
+func (c *dataCache) load(ctx context.Context, cfg *AppConfig, mock string, onSync func(prev, data *YNABData)) (*YNABData, error) {
+	c.mut.Lock()
+	c.reconfigure(cfg)
 
-	start := time.Now()
-	var data *YNABData
 	if mock, ok := MockData[mock]; ok {
-		data = mock()
-	} else {
-		var err error
-		data, err = LoadYNABData(ctx, &appCfg)
-		if err != nil {
+		defer c.mut.Unlock()
+		if c.data == nil || c.expired || time.Since(c.ts) >= cacheDuration {
+			c.data, c.ts, c.expired = mock(), time.Now(), false
+		}
+		return c.data, nil
+	}
+
+	if c.data != nil && !c.expired {
+		if c.unsynced || time.Since(c.ts) >= cacheDuration {
+			c.startLoad(cfg, onSync)
+		}
+		data := c.data
+		c.mut.Unlock()
+		return data, nil
+	}
+
+	gen := c.gen
+	for {
+		l := c.startLoad(cfg, onSync)
+		if l == nil {
+			// Throttled or backing off, see startLoad; with no data, the
+			// error of the last load stands until the backoff ends
+			data, err := c.data, c.loadErr
+			c.mut.Unlock()
+			if data != nil {
+				return data, nil
+			}
 			return nil, err
 		}
-		log.Printf("Loaded YNAB data in %v ms", time.Since(start).Milliseconds())
+		c.mut.Unlock()
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			// The load goes on for whoever asks next
+			return nil, ctx.Err()
+		}
+		c.mut.Lock()
+		if l.err != nil && c.data != nil {
+			data := c.data
+			c.mut.Unlock()
+			return data, nil
+		}
+		if l.err != nil || l.gen >= gen {
+			c.mut.Unlock()
+			return l.data, l.err
+		}
+		// Joined a load started before expire, which may miss the change
 	}
+}
 
-	cachedData = data
-	cachedDataTS = start
-	return data, nil
+// notice explains why the cached data is out of date, if it is
+func (c *dataCache) notice() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	switch {
+	case c.data == nil:
+		return ""
+	case c.limited:
+		return staleDataNotice("YNAB rate limited", c.ts)
+	case c.loadErr != nil:
+		return staleDataNotice("Couldn't reach YNAB", c.ts)
+	}
+	return ""
 }
 
+// staleDataNotice is shown above the form when the data is out of date
+func staleDataNotice(problem string, loaded time.Time) string {
+	var ago string
+	switch minutes := int(time.Since(loaded).Minutes()); minutes {
+	case 0:
+		ago = "less than a minute ago"
+	case 1:
+		ago = "1 minute ago"
+	default:
+		ago = fmt.Sprintf("%d minutes ago", minutes)
+	}
+	return problem + ", showing data from " + ago + "."
+}
+
+// refresh starts a background load once the data is older than interval
+// plus a random part of jitter, so that pages rarely wait for YNAB
+func (c *dataCache) refresh(cfg *AppConfig, interval, jitter time.Duration, onSync func(prev, data *YNABData)) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.reconfigure(cfg)
+	if c.data != nil && !c.unsynced && time.Since(c.ts) < interval+c.jitter {
+		return
+	}
+	if c.startLoad(cfg, onSync) != nil {
+		c.jitter = time.Duration(rand.Int64N(int64(jitter) + 1))
+	}
+}
+
+// reconfigure starts over after a config reload, from the data saved on
+// disk if any, or else with a full load. The saved data is synced right
+// away, which also checks that it's still of the configured budget. Loads
+// still running with the old config are left to finish unused.
+func (c *dataCache) reconfigure(cfg *AppConfig) {
+	if c.cfg != cfg {
+		c.reset()
+		c.cfg = cfg
+		if cfg != nil {
+			c.data, c.ts = readCacheFile(cfg)
+			c.unsynced = c.data != nil
+		}
+	}
+}
+
+func (c *dataCache) reset() {
+	c.data = nil
+	c.cfg = nil
+	c.ts = time.Time{}
+	c.unsynced = false
+	c.expired = false
+	c.inflight = nil
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.limited = false
+	c.loadErr = nil
+}
+
+// startLoad returns the load in progress, or starts a new one. It returns
+// nil instead when there's data to show and few YNAB requests left, and
+// while backing off after failures. Must be called with c.mut held.
+func (c *dataCache) startLoad(cfg *AppConfig, onSync func(prev, data *YNABData)) *cacheLoad {
+	if c.inflight != nil {
+		return c.inflight
+	}
+	if c.data != nil && ynabBudgetLow(cfg.YNABToken) {
+		c.limited = true
+		return nil
+	}
+	if time.Now().Before(c.retryAt) {
+		return nil
+	}
+	l := &cacheLoad{cfg: cfg, gen: c.gen, done: make(chan struct{})}
+	c.inflight = l
+	go c.run(l, c.data, onSync)
+	return l
+}
+
+// run performs the load, detached from the requests waiting for it
+func (c *dataCache) run(l *cacheLoad, prev *YNABData, onSync func(prev, data *YNABData)) {
+	defer close(l.done)
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+
+	start := time.Now()
+	data, err := LoadYNABData(ctx, l.cfg, prev)
+	if c.finish(l, prev, data, err, start, onSync) {
+		if err := writeCacheFile(l.cfg, data, start); err != nil {
+			log.Printf("WARNING: saving YNAB data for %q: %v", l.cfg.budgetLabel(), err)
+		}
+	}
+}
+
+// finish records the outcome of a load, returning whether its data is now
+// the cached one
+func (c *dataCache) finish(l *cacheLoad, prev, data *YNABData, err error, start time.Time, onSync func(prev, data *YNABData)) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	l.data, l.err = data, err
+	if c.inflight != l {
+		return false // the config was reloaded meanwhile
+	}
+	c.inflight = nil
+
+	if err != nil {
+		c.limited = isRateLimited(err)
+		c.loadErr = err
+		c.failures++
+		backoff := min(maxBackoff, minBackoff<<min(c.failures-1, 10))
+		c.retryAt = time.Now().Add(backoff)
+		log.Printf("WARNING: loading YNAB data for %q failed (%d in a row, retrying in %v): %v", l.cfg.budgetLabel(), c.failures, backoff, err)
+		return false
+	}
+	log.Printf("Loaded YNAB data for %q in %v ms", l.cfg.budgetLabel(), time.Since(start).Milliseconds())
+	for _, op := range l.redo {
+		op(data)
+	}
+	if onSync != nil {
+		onSync(prev, data)
+	}
+	c.data = data
+	c.ts = start
+	c.unsynced = false
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.limited = false
+	c.loadErr = nil
+	if l.gen == c.gen {
+		c.expired = false
+	}
+	return true
+}
+
+// expire forces the next load to wait for a sync with YNAB, reusing the
+// cached data as a base for a delta request.
+func (c *dataCache) expire() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.gen++
+	c.expired = true
+}
+
+func (c *dataCache) clear() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.reset()
+}
+
+// clearCache drops the cached data of all profiles
 func clearCache() {
-	cachedDataMut.Lock()
-	defer cachedDataMut.Unlock()
-	cachedData = nil
-	cachedDataTS = time.Time{}
+	cachesMut.Lock()
+	all := slices.Collect(maps.Values(caches))
+	cachesMut.Unlock()
+	for _, c := range all {
+		c.clear()
+	}
+}
+
+// refreshPeriodically keeps the data of every profile fresh in the
+// background, following config reloads
+func refreshPeriodically() {
+	for range time.Tick(refreshTick) {
+		apps := currentApps.Load()
+		for _, app := range apps.all() {
+			if app.RefreshInterval > 0 {
+				app.cache().refresh(app.Config, app.RefreshInterval, app.RefreshJitter, app.auditSync)
+			}
+		}
+	}
+}
+
+// update publishes a copy of the cached data with an optimistic change
+// applied, leaving the snapshots already handed out as they were. The change
+// is also applied to the result of the load in progress, if any.
+func (c *dataCache) update(op func(data *YNABData)) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.data == nil {
+		return
+	}
+	next := c.data.clone()
+	op(next)
+	c.data = next
+	if c.inflight != nil {
+		c.inflight.redo = append(c.inflight.redo, op)
+	}
+}
+
+func (c *dataCache) appendTransaction(tx *YNABTransaction) {
+	c.update(func(data *YNABData) {
+		if tx.ID != "" && data.TransactionByID(tx.ID) != nil {
+			return
+		}
+		data.Transactions = append(data.Transactions, tx)
+		applyTransactionToBalances(data, tx, 1)
+	})
+}
+
+func (c *dataCache) replaceTransaction(tx *YNABTransaction) {
+	c.update(func(data *YNABData) {
+		for i, old := range data.Transactions {
+			if old.ID == tx.ID {
+				applyTransactionToBalances(data, old, -1)
+				data.Transactions[i] = tx
+				applyTransactionToBalances(data, tx, 1)
+				return
+			}
+		}
+	})
+}
+
+func (c *dataCache) removeTransaction(id string) {
+	c.update(func(data *YNABData) {
+		for i, old := range data.Transactions {
+			if old.ID == id {
+				applyTransactionToBalances(data, old, -1)
+				data.Transactions = slices.Delete(data.Transactions, i, i+1)
+				return
+			}
+		}
+	})
 }
 
-func appendTransactionToCachedData(tx *YNABTransaction) {
-	cachedDataMut.Lock()
-	defer cachedDataMut.Unlock()
-	if cachedData == nil {
+// applyTransactionToBalances adds (sign=1) or reverts (sign=-1) the effect
+// of a transaction on the account and category balances in data, which
+// must not have been handed out yet.
+func applyTransactionToBalances(data *YNABData, tx *YNABTransaction, sign Amount) {
+	if account := data.AccountByID(tx.Account.ID); account != nil {
+		account.Balance += sign * tx.Amount
+	}
+	if tx.TransferAccount != nil {
+		if account := data.AccountByID(tx.TransferAccount.ID); account != nil {
+			account.Balance -= sign * tx.Amount
+		}
+		return
+	}
+	if tx.IsSplit() {
+		for _, sub := range tx.Subtransactions {
+			if sub.Category != nil {
+				applyToCategory(data, sub.Category.ID, tx.Date, sign*sub.Amount)
+			}
+		}
+	} else if tx.Category != nil {
+		applyToCategory(data, tx.Category.ID, tx.Date, sign*tx.Amount)
+	}
+}
+
+// applyToCategory approximates what YNAB does with an amount spent on the
+// given date: the categories hold the current month's figures, so earlier
+// spending only changes the balance carried over, and later spending
+// doesn't show up yet
+func applyToCategory(data *YNABData, categoryID, date string, amount Amount) {
+	c := data.CategoryByID(categoryID)
+	if c == nil || c.IsTransfer || len(date) < 7 {
+		return
+	}
+	month, thisMonth := date[:7], time.Now().Format("2006-01")
+	if month > thisMonth {
 		return
 	}
-	cachedData.Transactions = append(cachedData.Transactions, tx)
-	if account := cachedData.AccountByID(tx.Account.ID); account != nil {
-		account.Balance += tx.Amount
+	c.Balance += amount
+	if month == thisMonth {
+		c.Activity += amount
 	}
 }
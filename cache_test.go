@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedYNAB sits in front of a fake YNAB, counting loads and holding or
+// failing requests on demand
+type gatedYNAB struct {
+	mut     sync.Mutex
+	gate    chan struct{} // requests wait for it to close
+	failing bool
+	loads   int
+	paths   []string
+}
+
+func newGatedFakeYNAB(t *testing.T) (*gatedYNAB, *AppConfig) {
+	fake, cfg := newSeededFakeYNAB(t)
+	g := &gatedYNAB{gate: make(chan struct{})}
+	close(g.gate)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mut.Lock()
+		gate, failing := g.gate, g.failing
+		if strings.HasSuffix(r.URL.Path, "/accounts") {
+			g.loads++
+		}
+		g.paths = append(g.paths, r.URL.RequestURI())
+		g.mut.Unlock()
+		<-gate
+		if failing {
+			w.Header().Set("Retry-After", "0")
+			writeFakeError(w, http.StatusServiceUnavailable, "service_unavailable", "Down")
+			return
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	cfg.YNABBaseURL = proxy.URL + "/v1/"
+	return g, cfg
+}
+
+// hold makes requests wait until the returned function is called
+func (g *gatedYNAB) hold() (release func()) {
+	gate := make(chan struct{})
+	g.mut.Lock()
+	g.gate = gate
+	g.mut.Unlock()
+	return func() { close(gate) }
+}
+
+func (g *gatedYNAB) setFailing(failing bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.failing = failing
+}
+
+func (g *gatedYNAB) loadCount() int {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.loads
+}
+
+func (g *gatedYNAB) requests() []string {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return slices.Clone(g.paths)
+}
+
+// makeStale ages the cached data past cacheDuration
+func makeStale(c *dataCache) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.ts = time.Now().Add(-2 * cacheDuration)
+}
+
+func waitIdle(t *testing.T, c *dataCache) {
+	t.Helper()
+	c.mut.Lock()
+	l := c.inflight
+	c.mut.Unlock()
+	if l == nil {
+		return
+	}
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Load didn't finish")
+	}
+}
+
+func TestDataCache_sharedLoad(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+	release := ynab.hold()
+
+	var wg sync.WaitGroup
+	results := make([]*YNABData, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.load(context.Background(), cfg, "", nil)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = data
+		}()
+	}
+	release()
+	wg.Wait()
+	for _, data := range results {
+		if data == nil || data != results[0] {
+			t.Fatalf("Expected every caller to get the same data")
+		}
+	}
+	if n := ynab.loadCount(); n != 1 {
+		t.Errorf("Expected one load, got %d", n)
+	}
+}
+
+func TestDataCache_staleWhileRevalidate(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+	ctx := context.Background()
+	old, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale data comes back at once, even while YNAB is slow, and a single
+	// refresh happens behind it
+	makeStale(c)
+	release := ynab.hold()
+	for range 3 {
+		if data, err := c.load(ctx, cfg, "", nil); err != nil || data != old {
+			t.Fatalf("Expected the stale data, got %v", err)
+		}
+	}
+	release()
+	waitIdle(t, c)
+	if n := ynab.loadCount(); n != 2 {
+		t.Errorf("Expected one background load, got %d loads", n)
+	}
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data == old {
+		t.Errorf("Expected the refreshed data, got %v", err)
+	}
+
+	// After expire, the next load waits for YNAB
+	c.expire()
+	if _, err := c.load(ctx, cfg, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := ynab.loadCount(); n != 3 {
+		t.Errorf("Expected expire to wait for a load, got %d loads", n)
+	}
+}
+
+func TestDataCache_optimisticUpdateDuringLoad(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+	ctx := context.Background()
+	if _, err := c.load(ctx, cfg, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expense entered while a refresh is waiting on YNAB, which
+	// doesn't have it yet, survives the refresh
+	makeStale(c)
+	release := ynab.hold()
+	data, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := data.AccountByID("A1")
+	balance := account.Balance - 5_000
+	c.appendTransaction(&YNABTransaction{ID: "T9", Date: "2025-03-01", Amount: -5_000, Account: account})
+	release()
+	waitIdle(t, c)
+
+	data, err = c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.AccountByID("A1") == account {
+		t.Fatalf("Expected the refreshed data")
+	}
+	if data.TransactionByID("T9") == nil || data.AccountByID("A1").Balance != balance {
+		t.Errorf("Expected the entered expense after the refresh")
+	}
+}
+
+func TestDataCache_backoff(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+	ctx := context.Background()
+	old, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ynab.setFailing(true)
+	makeStale(c)
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data != old {
+		t.Fatalf("Expected the stale data while YNAB is down, got %v", err)
+	}
+	waitIdle(t, c)
+	loads := ynab.loadCount()
+
+	// A failed load isn't retried on every request
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data != old {
+		t.Fatalf("Expected the stale data while backing off, got %v", err)
+	}
+	c.mut.Lock()
+	failures, retryAt, inflight := c.failures, c.retryAt, c.inflight
+	c.mut.Unlock()
+	if failures != 1 || time.Until(retryAt) < minBackoff/2 || inflight != nil || ynab.loadCount() != loads {
+		t.Errorf("Expected to back off, got failures=%d retryAt=%v", failures, retryAt)
+	}
+
+	// After expire, the load waits for YNAB once the backoff is over, and
+	// when it fails, the old data comes back with a notice
+	endBackoff(c)
+	c.expire()
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data != old {
+		t.Fatalf("Expected the old data after a failed load, got %v", err)
+	}
+	if ynab.loadCount() == loads {
+		t.Errorf("Expected a load after expire")
+	}
+	if notice := c.notice(); notice != "Couldn't reach YNAB, showing data from 10 minutes ago." {
+		t.Errorf("notice = %q", notice)
+	}
+	loads = ynab.loadCount()
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data != old || ynab.loadCount() != loads {
+		t.Errorf("Expected the old data without a load while backing off, got %v", err)
+	}
+
+	ynab.setFailing(false)
+	endBackoff(c)
+	if data, err := c.load(ctx, cfg, "", nil); err != nil || data == old {
+		t.Fatalf("Expected the loaded data, got %v", err)
+	}
+	c.mut.Lock()
+	failures = c.failures
+	c.mut.Unlock()
+	if failures != 0 || c.notice() != "" {
+		t.Errorf("Expected a successful load to end the backoff, got failures=%d", failures)
+	}
+}
+
+func TestDataCache_firstLoadBackoff(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+	ctx := context.Background()
+
+	// With no data, the error of the failed load comes back without asking
+	// YNAB again until the backoff ends
+	ynab.setFailing(true)
+	_, err := c.load(ctx, cfg, "", nil)
+	if err == nil {
+		t.Fatal("Expected the error of the failed load")
+	}
+	loads := ynab.loadCount()
+	if _, err2 := c.load(ctx, cfg, "", nil); err2 == nil || err2.Error() != err.Error() || ynab.loadCount() != loads {
+		t.Errorf("Expected the same error without a load while backing off, got %v", err2)
+	}
+
+	ynab.setFailing(false)
+	endBackoff(c)
+	if _, err := c.load(ctx, cfg, "", nil); err != nil {
+		t.Errorf("Expected a load once the backoff ends, got %v", err)
+	}
+}
+
+// endBackoff lets the next load go ahead after a failure
+func endBackoff(c *dataCache) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.retryAt = time.Time{}
+}
+
+func TestDataCache_refresh(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	c := &dataCache{}
+
+	// The refresher loads the data before anyone asks
+	c.refresh(cfg, time.Minute, time.Second, nil)
+	waitIdle(t, c)
+	if ynab.loadCount() != 1 {
+		t.Fatalf("Expected the refresher to load the data")
+	}
+	c.refresh(cfg, time.Minute, time.Second, nil)
+	waitIdle(t, c)
+	if ynab.loadCount() != 1 {
+		t.Errorf("Expected no refresh of fresh data")
+	}
+	makeStale(c)
+	c.refresh(cfg, time.Minute, time.Second, nil)
+	waitIdle(t, c)
+	if ynab.loadCount() != 2 {
+		t.Errorf("Expected a refresh of stale data")
+	}
+}
+
+func TestParseConfigDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", cacheDuration, false},
+		{"0", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"-1m", 0, true},
+		{"5", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigDuration(tt.input, cacheDuration)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseConfigDuration(%q) = %v, %v", tt.input, got, err)
+		}
+	}
+}
+
+func TestDataCache_snapshots(t *testing.T) {
+	app := newFakeYNABApp(t)
+	before := mustLoadData(t, app)
+	balance, count := before.AccountByID("A1").Balance, len(before.Transactions)
+
+	app.cache().appendTransaction(&YNABTransaction{ID: "T9", Date: "2025-03-01", Amount: -5_000, Account: before.AccountByID("A1")})
+	after := mustLoadData(t, app)
+	if before.AccountByID("A1").Balance != balance || len(before.Transactions) != count || before.TransactionByID("T9") != nil {
+		t.Errorf("Expected the earlier snapshot unchanged")
+	}
+	if after.AccountByID("A1").Balance != balance-5_000 || after.TransactionByID("T9") == nil {
+		t.Errorf("Expected the change in the new snapshot")
+	}
+
+	app.cache().removeTransaction("T9")
+	if after.TransactionByID("T9") == nil || mustLoadData(t, app).TransactionByID("T9") != nil {
+		t.Errorf("Expected the removal in a new snapshot only")
+	}
+}
+
+// TestDataCache_concurrent is meant for go test -race: pages read the data
+// while expenses are entered and the cache refreshes
+func TestDataCache_concurrent(t *testing.T) {
+	app := newFakeYNABApp(t)
+	ctx := context.Background()
+	mustLoadData(t, app)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				w := httptest.NewRecorder()
+				if err := app.handleIndex(w, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 5 {
+				form := url.Values{
+					"date":     {"2025-02-01"},
+					"amount":   {strconv.Itoa(10*i + j + 1)},
+					"currency": {"GEL"},
+					"account":  {"A1"},
+					"category": {"C2"},
+					"comment":  {"Concurrent"},
+				}
+				req := httptest.NewRequest(http.MethodPost, "/enter", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				if err := app.handleEnterExpense(w, req); err != nil || w.Code != http.StatusSeeOther {
+					t.Errorf("POST /enter: %d %v", w.Code, err)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 5 {
+			makeStale(app.cache())
+			if _, err := app.loadData(ctx, ""); err != nil {
+				t.Error(err)
+			}
+			app.cache().expire()
+		}
+	}()
+	wg.Wait()
+
+	waitIdle(t, app.cache())
+	app.cache().expire()
+	var entered int
+	for _, tx := range mustLoadData(t, app).Transactions {
+		if strings.HasSuffix(tx.Comment, "Concurrent") {
+			entered++
+		}
+	}
+	if entered != 10 {
+		t.Errorf("Expected 10 entered expenses, got %d", entered)
+	}
+}
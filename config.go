@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/andreyvit/jsonfix"
+)
+
+// envOverrides lists the environment variables that take precedence over the
+// config file, so that secrets like the YNAB token can be kept out of it.
+var envOverrides = []struct {
+	name  string
+	field func(cfg *AppConfig) *string
+}{
+	{"YNAB_TOKEN", func(cfg *AppConfig) *string { return &cfg.YNABToken }},
+	{"YNAB_BASE_URL", func(cfg *AppConfig) *string { return &cfg.YNABBaseURL }},
+	{"YNAB_BUDGET", func(cfg *AppConfig) *string { return &cfg.BudgetName }},
+	{"YNAB_BUDGET_ID", func(cfg *AppConfig) *string { return &cfg.BudgetID }},
+	{"PAGE_TITLE", func(cfg *AppConfig) *string { return &cfg.PageTitle }},
+	{"SESSION_SECRET", func(cfg *AppConfig) *string { return &cfg.SessionSecret }},
+}
+
+// loadConfig reads the config file (JSON, trailing commas allowed) and
+// applies the environment overrides.
+func loadConfig(path string) (*AppConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &AppConfig{}
+	if err := json.Unmarshal(jsonfix.Bytes(raw), cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, o := range envOverrides {
+		if v, ok := os.LookupEnv(o.name); ok {
+			*o.field(cfg) = v
+		}
+	}
+	return cfg, nil
+}
+
+// budgetLabel names the budget in log messages
+func (cfg *AppConfig) budgetLabel() string {
+	return cmp.Or(cfg.BudgetName, cfg.BudgetID)
+}
+
+// profileNameRe limits profile names to what reads well in a URL
+var profileNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// profileConfig returns the config of a profile: the top-level settings with
+// the ones given in the profile replacing them.
+func (cfg *AppConfig) profileConfig(name string) (*AppConfig, error) {
+	result := *cfg
+	result.Profiles = nil
+
+	// Lists given in the profile replace the top-level ones; decoding into
+	// them would overwrite the shared elements instead.
+	result.Categories, result.Accounts, result.HideBalance, result.Currencies, result.Presets = nil, nil, nil, nil, nil
+	if err := json.Unmarshal(cfg.Profiles[name], &result); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	if result.Categories == nil {
+		result.Categories = cfg.Categories
+	}
+	if result.Accounts == nil {
+		result.Accounts = cfg.Accounts
+	}
+	if result.HideBalance == nil {
+		result.HideBalance = cfg.HideBalance
+	}
+	if result.Currencies == nil {
+		result.Currencies = cfg.Currencies
+	}
+	if result.Presets == nil {
+		result.Presets = cfg.Presets
+	}
+	if len(result.Profiles) > 0 {
+		return nil, fmt.Errorf("profile %s: profiles can't be nested", name)
+	}
+	return &result, nil
+}
+
+// appSet holds the App of the default form and of every profile
+type appSet struct {
+	Default   *App
+	Profiles  map[string]*App
+	Auth      *authenticator // nil if the config lists no users
+	APITokens apiTokens
+}
+
+func newAppSet(cfg *AppConfig) (*appSet, error) {
+	app, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newAPITokens(cfg, auth)
+	if err != nil {
+		return nil, err
+	}
+	apps := &appSet{
+		Default:   app,
+		Profiles:  make(map[string]*App, len(cfg.Profiles)),
+		Auth:      auth,
+		APITokens: tokens,
+	}
+	for name := range cfg.Profiles {
+		if !profileNameRe.MatchString(name) || name == defaultProfileName {
+			return nil, fmt.Errorf("invalid profile name %q, use letters, digits, - and _", name)
+		}
+		pcfg, err := cfg.profileConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		app, err := New(pcfg)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		app.Profile = name
+		app.BasePath = "/p/" + name
+		apps.Profiles[name] = app
+	}
+	return apps, nil
+}
+
+// currentApps serves requests. A config reload replaces all Apps at once;
+// requests in flight finish with the App they started with.
+var currentApps atomic.Pointer[appSet]
+
+// route adapts an App method for http.HandleFunc, calling it on the current
+// App of the profile named in the URL on behalf of the logged-in user
+func route(h func(app *App, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		apps := currentApps.Load()
+		app := apps.profileApp(r)
+		if app == nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		if apps.Auth != nil {
+			u := apps.Auth.userFromRequest(r)
+			if u == nil {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return nil
+			} else if !u.canUseProfile(app.Profile) {
+				http.Error(w, "You don't have access to this form.", http.StatusForbidden)
+				return nil
+			}
+			r = r.WithContext(withUser(r.Context(), u))
+		}
+		return h(app, w, r)
+	})
+}
+
+// routePublic is like route, but for pages served without a login
+func routePublic(h func(app *App, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return wrap(func(w http.ResponseWriter, r *http.Request) error {
+		app := currentApps.Load().profileApp(r)
+		if app == nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		return h(app, w, r)
+	})
+}
+
+// profileApp returns the App of the profile named in the URL, or nil if
+// there's no such profile
+func (apps *appSet) profileApp(r *http.Request) *App {
+	if name := r.PathValue("profile"); name != "" {
+		return apps.Profiles[name]
+	}
+	return apps.Default
+}
+
+// all returns the default App followed by the profiles' ones
+func (apps *appSet) all() []*App {
+	result := []*App{apps.Default}
+	for _, name := range slices.Sorted(maps.Keys(apps.Profiles)) {
+		result = append(result, apps.Profiles[name])
+	}
+	return result
+}
+
+// reloadOnSIGHUP rebuilds the Apps whenever the process receives SIGHUP. If
+// the new config is broken, the old Apps stay in place.
+func reloadOnSIGHUP(build func() (*appSet, error)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			apps, err := build()
+			if err != nil {
+				log.Printf("WARNING: config reload failed, keeping the previous config: %v", err)
+				continue
+			}
+			currentApps.Store(apps)
+			log.Printf("Config reloaded")
+		}
+	}()
+}
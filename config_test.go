@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTempFile(t, "config.json", `{
+		"ynabToken": "from-file",
+		"budget": "Family Budget",
+		"currencies": [
+			{"code": "USD", "format": "$9.99", "rate": 1.0},
+		],
+	}`)
+	t.Setenv("YNAB_TOKEN", "from-env")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.YNABToken != "from-env" {
+		t.Errorf("YNABToken = %q, wanted the env override", cfg.YNABToken)
+	}
+	if cfg.BudgetName != "Family Budget" || len(cfg.Currencies) != 1 {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestRoute_reload(t *testing.T) {
+	newTitledApps := func(title string) *appSet {
+		apps, err := newAppSet(&AppConfig{
+			PageTitle:       title,
+			Currencies:      []CurrencyConfig{{Code: "USD", Rate: 1.0, Format: "$9.99"}},
+			BudgetCurrency:  "USD",
+			DefaultCurrency: "USD",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return apps
+	}
+	t.Cleanup(clearCache)
+	handler := route((*App).handleIndex)
+
+	for _, title := range []string{"Before Reload", "After Reload"} {
+		currentApps.Store(newTitledApps(title))
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/?mock=simple", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), title) {
+			t.Errorf("%s: status %d, title missing", title, w.Code)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	path := writeTempFile(t, "config.json", `{
+		"page_title": "House Expenses",
+		"budget": "Family Budget",
+		"categories": ["Groceries"],
+		"currencies": [
+			{"code": "USD", "format": "$9.99", "rate": 1.0},
+			{"code": "GEL", "format": "₾9.99", "rate": 2.6},
+		],
+		"budget_currency": "USD",
+		"default_currency": "GEL",
+		"profiles": {
+			"pets": {
+				"page_title": "Pet Expenses",
+				"categories": ["Pet Food"],
+				"currencies": [{"code": "USD", "format": "$9.99", "rate": 1.0}],
+				"default_currency": "USD",
+			},
+		},
+	}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps, err := newAppSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pets := apps.Profiles["pets"]
+	if pets == nil || pets.Config.BudgetName != "Family Budget" || pets.Config.Categories[0] != "Pet Food" || len(pets.Currencies) != 1 {
+		t.Fatalf("pets profile = %+v", pets)
+	}
+	if c := apps.Default.Config; c.Categories[0] != "Groceries" || len(c.Currencies) != 2 || c.Currencies[0].Code != "USD" {
+		t.Errorf("default config changed by the profile: %+v", c)
+	}
+
+	currentApps.Store(apps)
+	t.Cleanup(clearCache)
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	for path, expected := range map[string]string{
+		"/?mock=simple":        `action="/enter"`,
+		"/p/pets/?mock=simple": `action="/p/pets/enter"`,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%s: status %d, wanted %s in the page", path, w.Code, expected)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/p/nobody/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown profile: status %d", w.Code)
+	}
+}
@@ -4,6 +4,7 @@ set -euo pipefail
 hostname="$1"
 temp_file="$2"
 password="$3"
+config_file="$4"
 username=$USER
 port=3320
 
@@ -16,8 +17,20 @@ SUDO() { echo "# $@" >&2; sudo "$@"; }
 # ===========================================================================
 
 SUDO install -d -m755 -g $username -o $username /srv/ynabexpenseform/bin
+# relative paths in config.json, like audit_log, end up here
+SUDO install -d -m750 -g $username -o $username /srv/ynabexpenseform/data
 
 SUDO install -m 755 -o root -g root ~/$temp_file /srv/ynabexpenseform/bin/ynabexpenseform
+SUDO install -m 640 -o root -g $username ~/$config_file /srv/ynabexpenseform/config.json
+
+# with users in config.json, the app asks for a login itself
+basic_auth=""
+if ! grep -q '"users"' ~/$config_file; then
+    basic_auth="basic_auth * {
+        assistant $password
+    }"
+fi
+rm ~/$config_file
 
 SUDO install -m644 -groot -oroot /dev/stdin /etc/systemd/system/ynabexpenseform.service <<EOF
 [Unit]
@@ -31,7 +44,9 @@ Restart=always
 RestartSec=500ms
 PIDFile=/run/ynabexpenseform.pid
 Type=simple
-ExecStart=/srv/ynabexpenseform/bin/ynabexpenseform -listen 127.0.0.1:$port
+WorkingDirectory=/srv/ynabexpenseform/data
+ExecStart=/srv/ynabexpenseform/bin/ynabexpenseform -listen 127.0.0.1:$port -config /srv/ynabexpenseform/config.json
+ExecReload=/bin/kill -HUP \$MAINPID
 KillMode=process
 
 [Install]
@@ -40,9 +55,7 @@ EOF
 
 SUDO install -m644 -groot -oroot /dev/stdin /srv/ynabexpenseform/Caddyfile <<EOF
 $hostname {
-    basic_auth * {
-        assistant $password
-    }
+    $basic_auth
     reverse_proxy * http://127.0.0.1:$port {
         lb_try_duration 30s
         lb_try_interval 500ms
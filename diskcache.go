@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// cacheFileVersion changes with the layout of cacheFile itself; changes to
+// the YNAB entities are caught by syncSchema
+const cacheFileVersion = 1
+
+// cacheFile is what's saved in cache_dir after each load, so that a restart
+// serves the data right away and follows up with a delta sync rather than a
+// full one
+type cacheFile struct {
+	Version    int            `json:"version"`
+	Schema     string         `json:"schema"`
+	ConfigHash string         `json:"config_hash"`
+	BudgetID   string         `json:"budget_id"`
+	SavedAt    time.Time      `json:"saved_at"`
+	Sync       *YNABSyncState `json:"sync"`
+}
+
+// syncSchema fingerprints the fields of YNABSyncState. Entities that a delta
+// sync doesn't resend would keep the zero value of a field added since they
+// were saved, so a file with another schema is dropped.
+var syncSchema = func() string {
+	var b strings.Builder
+	describeType(&b, reflect.TypeFor[YNABSyncState](), make(map[reflect.Type]bool))
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}()
+
+func describeType(b *strings.Builder, t reflect.Type, seen map[reflect.Type]bool) {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice:
+		b.WriteString("[" + t.Kind().String() + "]")
+		describeType(b, t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			b.WriteString(t.Name())
+			return
+		}
+		seen[t] = true
+		b.WriteString(t.Name() + "{")
+		for i := range t.NumField() {
+			f := t.Field(i)
+			fmt.Fprintf(b, "%s %q ", f.Name, f.Tag.Get("json"))
+			describeType(b, f.Type, seen)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(t.Kind().String())
+	}
+}
+
+// cacheConfigHash covers the settings that decide what is loaded from YNAB.
+// The rest, like the categories and accounts shown, apply when the saved
+// state is turned into YNABData, so changing them keeps the file.
+func cacheConfigHash(cfg *AppConfig) string {
+	h := sha256.New()
+	for _, s := range []string{cfg.YNABBaseURL, cfg.YNABToken, cfg.BudgetID, cfg.BudgetName, cfg.BudgetMatch} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// cacheFilePath returns where the data is saved, or "" if cache_dir isn't set
+func cacheFilePath(cfg *AppConfig) string {
+	if cfg.CacheDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.CacheDir, "ynab-"+cacheConfigHash(cfg)+".json")
+}
+
+// readCacheFile returns the saved data and when it was loaded from YNAB, or
+// nil if there's none. A file that can't be used is deleted.
+func readCacheFile(cfg *AppConfig) (*YNABData, time.Time) {
+	path := cacheFilePath(cfg)
+	if path == "" {
+		return nil, time.Time{}
+	}
+	data, savedAt, err := decodeCacheFile(cfg, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}
+	} else if err != nil {
+		log.Printf("WARNING: dropping cached YNAB data in %s: %v", path, err)
+		os.Remove(path)
+		return nil, time.Time{}
+	}
+	log.Printf("Loaded YNAB data for %q from %s, saved %v ago", cfg.budgetLabel(), path, time.Since(savedAt).Round(time.Second))
+	return data, savedAt
+}
+
+func decodeCacheFile(cfg *AppConfig, path string) (*YNABData, time.Time, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var f cacheFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, time.Time{}, fmt.Errorf("corrupted: %w", err)
+	}
+	switch {
+	case f.Version != cacheFileVersion:
+		return nil, time.Time{}, fmt.Errorf("version %d, want %d", f.Version, cacheFileVersion)
+	case f.Schema != syncSchema:
+		return nil, time.Time{}, fmt.Errorf("saved with another schema")
+	case f.ConfigHash != cacheConfigHash(cfg):
+		return nil, time.Time{}, fmt.Errorf("saved for another budget or token")
+	case f.BudgetID == "" || f.Sync == nil || f.SavedAt.IsZero():
+		return nil, time.Time{}, fmt.Errorf("incomplete")
+	}
+	// The settings may pick another budget by now, like last-used after
+	// switching budgets; the first sync checks if it isn't known yet
+	if id := knownBudgetID(cfg); id != "" && id != f.BudgetID {
+		return nil, time.Time{}, fmt.Errorf("saved for budget %s, now %s", f.BudgetID, id)
+	}
+	data, err := buildYNABData(cfg, f.BudgetID, f.Sync)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, f.SavedAt, nil
+}
+
+// writeCacheFile saves the data loaded at savedAt, replacing the previous
+// file only once the new one is complete
+func writeCacheFile(cfg *AppConfig, data *YNABData, savedAt time.Time) error {
+	path := cacheFilePath(cfg)
+	if path == "" || data.Sync == nil {
+		return nil
+	}
+	raw, err := json.Marshal(&cacheFile{
+		Version:    cacheFileVersion,
+		Schema:     syncSchema,
+		ConfigHash: cacheConfigHash(cfg),
+		BudgetID:   data.BudgetID,
+		SavedAt:    savedAt,
+		Sync:       data.Sync,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(cfg.CacheDir, ".ynab-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
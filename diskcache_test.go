@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	ynab, cfg := newGatedFakeYNAB(t)
+	cfg.CacheDir = t.TempDir()
+	ctx := context.Background()
+
+	c := &dataCache{}
+	loaded, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := cacheFilePath(cfg)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the data saved: %v", err)
+	}
+
+	// After a restart, the saved data is served without waiting for YNAB,
+	// and followed up with a delta sync
+	c = &dataCache{}
+	release := ynab.hold()
+	before := len(ynab.requests())
+	data, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.BudgetID != loaded.BudgetID || len(data.Transactions) != len(loaded.Transactions) || data.Sync.Knowledge != loaded.Sync.Knowledge {
+		t.Errorf("Expected the saved data, got %+v", data)
+	}
+	release()
+	waitIdle(t, c)
+	requests := ynab.requests()[before:]
+	if len(requests) == 0 {
+		t.Errorf("Expected a sync")
+	}
+	for _, r := range requests {
+		if !strings.Contains(r, "last_knowledge_of_server=") {
+			t.Errorf("Expected a delta request, got %s", r)
+		}
+	}
+
+	// Another budget doesn't use the file
+	other := *cfg
+	other.BudgetName = "Other Budget"
+	if data, _ := readCacheFile(&other); data != nil || cacheFilePath(&other) == path {
+		t.Errorf("Expected no saved data for another budget")
+	}
+	// Settings that don't change what's loaded keep it
+	other = *cfg
+	other.Categories = []string{"Groceries"}
+	if data, _ := readCacheFile(&other); data == nil || len(data.Categories) != 1 {
+		t.Errorf("Expected the saved data limited to the configured categories")
+	}
+}
+
+func TestDiskCache_otherBudget(t *testing.T) {
+	fake, cfg := newSeededFakeYNAB(t)
+	cfg.CacheDir = t.TempDir()
+	ctx := context.Background()
+	t.Cleanup(func() { forgetBudgetID(cfg) })
+	if _, err := (&dataCache{}).load(ctx, cfg, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Picked by name, the budget is another one after a restart, so the
+	// saved data is replaced by a full load of the new one
+	fake.RenameBudget("B7", "Family Budget")
+	forgetBudgetID(cfg)
+	fake.Requests()
+	c := &dataCache{}
+	c.load(ctx, cfg, "", nil)
+	waitIdle(t, c)
+	for _, r := range fake.Requests() {
+		if strings.Contains(r, "/budgets/B1/") {
+			t.Errorf("Expected no requests for the old budget, got %s", r)
+		}
+	}
+	data, err := c.load(ctx, cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := readCacheFile(cfg); data.BudgetID != "B7" || saved == nil || saved.BudgetID != "B7" {
+		t.Errorf("Expected the new budget loaded and saved, got %q", data.BudgetID)
+	}
+
+	// Once the budget is known, a file saved for another one is dropped
+	old := *data
+	old.BudgetID = "B1"
+	if err := writeCacheFile(cfg, &old, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := readCacheFile(cfg); saved != nil {
+		t.Errorf("Expected the file of the old budget dropped")
+	}
+}
+
+func TestDiskCache_dropsBadFiles(t *testing.T) {
+	_, cfg := newSeededFakeYNAB(t)
+	cfg.CacheDir = t.TempDir()
+	data, err := LoadYNABData(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := cacheFilePath(cfg)
+
+	tests := map[string]func(f map[string]any){
+		"old version":    func(f map[string]any) { f["version"] = cacheFileVersion - 1 },
+		"another schema": func(f map[string]any) { f["schema"] = "0000" },
+		"no budget":      func(f map[string]any) { delete(f, "budget_id") },
+		"no state":       func(f map[string]any) { f["sync"] = nil },
+	}
+	for name, corrupt := range tests {
+		if err := writeCacheFile(cfg, data, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := os.ReadFile(path)
+		var f map[string]any
+		json.Unmarshal(raw, &f)
+		corrupt(f)
+		raw, _ = json.Marshal(f)
+		os.WriteFile(path, raw, 0o600)
+
+		if data, _ := readCacheFile(cfg); data != nil {
+			t.Errorf("%s: expected the file to be dropped", name)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the file to be deleted", name)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"version": 1, "sync": {"accou`), 0o600)
+	if data, _ := readCacheFile(cfg); data != nil {
+		t.Errorf("Expected a truncated file to be dropped")
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeYNAB is an in-process, in-memory stand-in for the YNAB v1 API, used by
+// tests and by the -fake-ynab flag. It honors last_knowledge_of_server on the
+// delta-capable endpoints, and transactions created through it show up in
+// later listings.
+type FakeYNAB struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	knowledge    int64
+	lastID       int
+	changedAt    map[string]int64
+	requests     []string
+	budgetID     string
+	budgetName   string
+	accounts     []*apiAccount
+	payees       []*apiPayee
+	categories   []*apiCategory
+	transactions []*apiTransaction
+	rateLimit    int // requests allowed, 0 for no limit
+	rateUsed     int
+
+	// Budgets other than the one with the data, which are only listed
+	otherBudgets     []*apiBudget
+	defaultBudgetID  string
+	lastUsedBudgetID string // the main budget if empty
+}
+
+func NewFakeYNAB(budgetName string) *FakeYNAB {
+	f := &FakeYNAB{
+		changedAt:  make(map[string]int64),
+		budgetID:   "B1",
+		budgetName: budgetName,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/budgets", f.handleBudgets)
+	mux.HandleFunc("GET /v1/budgets/{budget}", f.handleBudget)
+	mux.HandleFunc("GET /v1/budgets/{budget}/accounts", f.handleAccounts)
+	mux.HandleFunc("GET /v1/budgets/{budget}/payees", f.handlePayees)
+	mux.HandleFunc("GET /v1/budgets/{budget}/categories", f.handleCategories)
+	mux.HandleFunc("GET /v1/budgets/{budget}/transactions", f.handleTransactions)
+	mux.HandleFunc("POST /v1/budgets/{budget}/transactions", f.handleCreateTransaction)
+	mux.HandleFunc("PUT /v1/budgets/{budget}/transactions/{id}", f.handleUpdateTransaction)
+	mux.HandleFunc("DELETE /v1/budgets/{budget}/transactions/{id}", f.handleDeleteTransaction)
+	f.Server = httptest.NewServer(f.logRequests(f.limitRate(f.requireToken(mux))))
+	return f
+}
+
+func (f *FakeYNAB) BaseURL() string {
+	return f.URL + "/v1/"
+}
+
+func (f *FakeYNAB) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := f.requests
+	f.requests = nil
+	return result
+}
+
+// Seed populates the fake with the budget, accounts and categories named in
+// the config, plus a few transactions to look at.
+func (f *FakeYNAB) Seed(cfg *AppConfig) {
+	f.mu.Lock()
+	f.budgetName = cfg.BudgetName
+	if cfg.BudgetID != "" && cfg.BudgetID != lastUsedBudget && cfg.BudgetID != defaultBudget {
+		f.budgetID = cfg.BudgetID
+	}
+	f.mu.Unlock()
+
+	for i, name := range cfg.Accounts {
+		f.AddAccount(fmt.Sprintf("A%d", i+1), name, Amount(100_000*(i+1)))
+	}
+	for i, name := range cfg.Categories {
+		f.AddCategory(fmt.Sprintf("C%d", i+1), name)
+		f.BudgetCategory(fmt.Sprintf("C%d", i+1), 200_000)
+	}
+	f.AddPayee("P1", "Corner Market")
+	if len(cfg.Accounts) > 0 && len(cfg.Categories) > 0 {
+		today := time.Now()
+		for i := range 3 {
+			f.PutTransaction(apiTransaction{
+				ID:         fmt.Sprintf("T%d", i+1),
+				AccountID:  "A1",
+				CategoryID: fmt.Sprintf("C%d", i%len(cfg.Categories)+1),
+				PayeeID:    "P1",
+				PayeeName:  "Corner Market",
+				Date:       today.AddDate(0, 0, i-3).Format("2006-01-02"),
+				Memo:       fmt.Sprintf("Sample expense %d", i+1),
+				Amount:     Amount(-1_500 * (i + 1)),
+			})
+		}
+	}
+}
+
+func (f *FakeYNAB) touch(id string) {
+	f.knowledge++
+	f.changedAt[id] = f.knowledge
+}
+
+func (f *FakeYNAB) AddAccount(id, name string, balance Amount) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.accounts = append(f.accounts, &apiAccount{ID: id, Name: name, Balance: balance, TransferPayeeID: "TP-" + id})
+	f.payees = append(f.payees, &apiPayee{ID: "TP-" + id, Name: "Transfer : " + name, TransferAccountID: id})
+	f.touch(id)
+	f.touch("TP-" + id)
+}
+
+func (f *FakeYNAB) AddCategory(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.categories = append(f.categories, &apiCategory{ID: id, CategoryGroupID: "G1", Name: name})
+	f.touch(id)
+}
+
+func (f *FakeYNAB) AddPayee(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.payees = append(f.payees, &apiPayee{ID: id, Name: name})
+	f.touch(id)
+}
+
+// BudgetCategory assigns money to a category for the current month.
+func (f *FakeYNAB) BudgetCategory(id string, amount Amount) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updateCategory(id, func(c *apiCategory) {
+		c.Budgeted += amount
+		c.Balance += amount
+	})
+}
+
+// PutTransaction adds or replaces a transaction and adjusts the account and
+// category balances.
+func (f *FakeYNAB) PutTransaction(t apiTransaction) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, old := range f.transactions {
+		if old.ID == t.ID {
+			f.adjustBalance(old.AccountID, -old.Amount)
+			f.adjustCategories(old, -1)
+			f.transactions[i] = &t
+			f.adjustBalance(t.AccountID, t.Amount)
+			f.adjustCategories(&t, 1)
+			f.touch(t.ID)
+			return
+		}
+	}
+	f.transactions = append(f.transactions, &t)
+	f.adjustBalance(t.AccountID, t.Amount)
+	f.adjustCategories(&t, 1)
+	f.touch(t.ID)
+}
+
+func (f *FakeYNAB) DeleteTransaction(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, old := range f.transactions {
+		if old.ID == id && !old.Deleted {
+			deleted := *old
+			deleted.Deleted = true
+			f.transactions[i] = &deleted
+			f.adjustBalance(old.AccountID, -old.Amount)
+			f.adjustCategories(old, -1)
+			f.touch(id)
+		}
+	}
+}
+
+func (f *FakeYNAB) adjustBalance(accountID string, delta Amount) {
+	for i, a := range f.accounts {
+		if a.ID == accountID {
+			updated := *a
+			updated.Balance += delta
+			f.accounts[i] = &updated
+			f.touch(a.ID)
+		}
+	}
+}
+
+// adjustCategories adds (sign=1) or reverts (sign=-1) the spending of a
+// transaction to its categories. Like in YNAB, the categories hold the
+// current month's figures.
+func (f *FakeYNAB) adjustCategories(t *apiTransaction, sign Amount) {
+	if len(t.Date) < 7 {
+		return
+	}
+	month, thisMonth := t.Date[:7], time.Now().Format("2006-01")
+	if month > thisMonth {
+		return
+	}
+	adjust := func(categoryID string, amount Amount) {
+		f.updateCategory(categoryID, func(c *apiCategory) {
+			c.Balance += sign * amount
+			if month == thisMonth {
+				c.Activity += sign * amount
+			}
+		})
+	}
+	if len(t.Subtransactions) > 0 {
+		for _, st := range t.Subtransactions {
+			adjust(st.CategoryID, st.Amount)
+		}
+	} else {
+		adjust(t.CategoryID, t.Amount)
+	}
+}
+
+func (f *FakeYNAB) updateCategory(id string, update func(c *apiCategory)) {
+	for i, c := range f.categories {
+		if c.ID == id {
+			updated := *c
+			update(&updated)
+			f.categories[i] = &updated
+			f.touch(c.ID)
+		}
+	}
+}
+
+func (f *FakeYNAB) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+		f.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRateLimit makes the fake report its use in X-Rate-Limit like YNAB does,
+// and turn requests away with 429 once used reaches limit
+func (f *FakeYNAB) SetRateLimit(used, limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rateUsed, f.rateLimit = used, limit
+}
+
+func (f *FakeYNAB) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		limit, exceeded := f.rateLimit, f.rateLimit > 0 && f.rateUsed >= f.rateLimit
+		if limit > 0 && !exceeded {
+			f.rateUsed++
+		}
+		used := f.rateUsed
+		f.mu.Unlock()
+		if limit > 0 {
+			w.Header().Set("X-Rate-Limit", fmt.Sprintf("%d/%d", used, limit))
+		}
+		if exceeded {
+			w.Header().Set("Retry-After", "0") // unlike YNAB, to keep tests fast
+			writeFakeError(w, http.StatusTooManyRequests, "too_many_requests", "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *FakeYNAB) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			writeFakeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *FakeYNAB) since(r *http.Request) (int64, bool) {
+	if r.PathValue("budget") != f.budgetID {
+		return 0, false
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("last_knowledge_of_server"), 10, 64)
+	return since, true
+}
+
+// changed reports whether an entity should be included in a response for
+// the given knowledge; full loads omit deleted entities.
+func (f *FakeYNAB) changed(e syncEntity, since int64) bool {
+	if since == 0 {
+		return !e.isDeleted()
+	}
+	return f.changedAt[e.entityID()] > since
+}
+
+// AddBudget lists another budget, without any data, next to the main one
+func (f *FakeYNAB) AddBudget(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.otherBudgets = append(f.otherBudgets, &apiBudget{ID: id, Name: name})
+}
+
+// SetLastUsedBudget sets the budget that last-used stands for, the main one
+// if empty
+func (f *FakeYNAB) SetLastUsedBudget(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastUsedBudgetID = id
+}
+
+// SetDefaultBudget sets the budget returned as default_budget, none if empty
+func (f *FakeYNAB) SetDefaultBudget(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defaultBudgetID = id
+}
+
+// RenameBudget renames the main budget and gives it a new ID, as if it
+// was restored from a backup
+func (f *FakeYNAB) RenameBudget(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.budgetID, f.budgetName = id, name
+}
+
+func (f *FakeYNAB) handleBudgets(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"budgets":        f.budgets(),
+		"default_budget": f.budgetByID(f.defaultBudgetID),
+	})
+}
+
+// handleBudget returns a budget by ID or alias. YNAB includes all of its
+// data too, which nothing here asks it for.
+func (f *FakeYNAB) handleBudget(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := r.PathValue("budget")
+	switch id {
+	case lastUsedBudget:
+		id = cmp.Or(f.lastUsedBudgetID, f.budgetID)
+	case defaultBudget:
+		id = f.defaultBudgetID
+	}
+	b := f.budgetByID(id)
+	if b == nil {
+		writeFakeError(w, http.StatusNotFound, "not_found", "Budget not found")
+		return
+	}
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"budget":           b,
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) budgets() []*apiBudget {
+	return append([]*apiBudget{{ID: f.budgetID, Name: f.budgetName}}, f.otherBudgets...)
+}
+
+func (f *FakeYNAB) budgetByID(id string) *apiBudget {
+	for _, b := range f.budgets() {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+func (f *FakeYNAB) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	since, ok := f.since(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"accounts":         filterChanged(f, f.accounts, since),
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) handlePayees(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	since, ok := f.since(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"payees":           filterChanged(f, f.payees, since),
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) handleCategories(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	since, ok := f.since(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"category_groups": []map[string]any{
+			{"id": "G1", "name": "Everything", "categories": filterChanged(f, f.categories, since)},
+		},
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	since, ok := f.since(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"transactions":     filterChanged(f, f.transactions, since),
+		"server_knowledge": f.knowledge,
+	})
+}
+
+type fakeTransactionInput struct {
+	AccountID  string  `json:"account_id"`
+	CategoryID *string `json:"category_id"`
+	PayeeID    string  `json:"payee_id"`
+	PayeeName  string  `json:"payee_name"`
+	Date       string  `json:"date"`
+	Amount     Amount  `json:"amount"`
+	Memo       string  `json:"memo"`
+	ImportID   string  `json:"import_id"`
+
+	Subtransactions []*apiSubtransaction `json:"subtransactions"`
+}
+
+func decodeFakeTransaction(w http.ResponseWriter, r *http.Request) (*fakeTransactionInput, bool) {
+	var input struct {
+		Transaction *fakeTransactionInput `json:"transaction"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err == nil && input.Transaction == nil {
+		err = fmt.Errorf("missing transaction")
+	}
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return nil, false
+	}
+	return input.Transaction, true
+}
+
+// saveTransaction creates or replaces a transaction, maintaining the
+// counterpart transaction in the other account for transfers.
+func (f *FakeYNAB) saveTransaction(id string, in *fakeTransactionInput) apiTransaction {
+	f.mu.Lock()
+	t := apiTransaction{
+		ID:        id,
+		AccountID: in.AccountID,
+		PayeeID:   in.PayeeID,
+		Date:      in.Date,
+		Memo:      in.Memo,
+		Amount:    in.Amount,
+		ImportID:  in.ImportID,
+	}
+	for i, st := range in.Subtransactions {
+		sub := *st
+		sub.ID = fmt.Sprintf("%s-%d", id, i+1)
+		t.Subtransactions = append(t.Subtransactions, &sub)
+	}
+	if in.CategoryID != nil {
+		t.CategoryID = *in.CategoryID
+	}
+	if in.PayeeID == "" && in.PayeeName != "" {
+		t.PayeeID = f.payeeNamed(in.PayeeName).ID
+	}
+	for _, p := range f.payees {
+		if p.ID == t.PayeeID {
+			t.PayeeName = p.Name
+		}
+		if p.ID == t.PayeeID && p.TransferAccountID != "" {
+			t.TransferAccountID = p.TransferAccountID
+			t.TransferTransactionID = t.ID + "-transfer"
+		}
+	}
+	f.mu.Unlock()
+
+	f.DeleteTransaction(id + "-transfer")
+	f.PutTransaction(t)
+	if t.TransferAccountID != "" {
+		f.PutTransaction(apiTransaction{
+			ID:                    t.TransferTransactionID,
+			AccountID:             t.TransferAccountID,
+			Date:                  t.Date,
+			Memo:                  t.Memo,
+			Amount:                -t.Amount,
+			TransferAccountID:     t.AccountID,
+			TransferTransactionID: t.ID,
+		})
+	}
+	return t
+}
+
+// payeeNamed finds the payee by name like YNAB does, creating it if needed
+func (f *FakeYNAB) payeeNamed(name string) *apiPayee {
+	for _, p := range f.payees {
+		if strings.EqualFold(p.Name, name) && !p.Deleted {
+			return p
+		}
+	}
+	f.lastID++
+	p := &apiPayee{ID: fmt.Sprintf("fake-payee-%d", f.lastID), Name: name}
+	f.payees = append(f.payees, p)
+	f.touch(p.ID)
+	return p
+}
+
+func (f *FakeYNAB) findTransaction(id string) *apiTransaction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range f.transactions {
+		if t.ID == id && !t.Deleted {
+			return t
+		}
+	}
+	return nil
+}
+
+// isMainBudget reports whether the request is for the budget with the data
+func (f *FakeYNAB) isMainBudget(r *http.Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return r.PathValue("budget") == f.budgetID
+}
+
+func (f *FakeYNAB) handleCreateTransaction(w http.ResponseWriter, r *http.Request) {
+	if !f.isMainBudget(r) {
+		http.NotFound(w, r)
+		return
+	}
+	in, ok := decodeFakeTransaction(w, r)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	if in.ImportID != "" {
+		for _, t := range f.transactions {
+			if t.ImportID == in.ImportID && t.AccountID == in.AccountID && !t.Deleted {
+				f.mu.Unlock()
+				writeFakeError(w, http.StatusConflict, "conflict", "A transaction with the same import_id already exists")
+				return
+			}
+		}
+	}
+	f.lastID++
+	id := fmt.Sprintf("fake-%d", f.lastID)
+	f.mu.Unlock()
+
+	t := f.saveTransaction(id, in)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeFakeData(w, http.StatusCreated, map[string]any{
+		"transaction_ids":  []string{t.ID},
+		"transaction":      t,
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) handleUpdateTransaction(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !f.isMainBudget(r) || f.findTransaction(id) == nil {
+		writeFakeError(w, http.StatusNotFound, "not_found", "Transaction not found")
+		return
+	}
+	in, ok := decodeFakeTransaction(w, r)
+	if !ok {
+		return
+	}
+
+	t := f.saveTransaction(id, in)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"transaction":      t,
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func (f *FakeYNAB) handleDeleteTransaction(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	t := f.findTransaction(id)
+	if !f.isMainBudget(r) || t == nil {
+		writeFakeError(w, http.StatusNotFound, "not_found", "Transaction not found")
+		return
+	}
+
+	f.DeleteTransaction(id)
+	if t.TransferTransactionID != "" {
+		f.DeleteTransaction(t.TransferTransactionID)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted := *t
+	deleted.Deleted = true
+	writeFakeData(w, http.StatusOK, map[string]any{
+		"transaction":      deleted,
+		"server_knowledge": f.knowledge,
+	})
+}
+
+func filterChanged[T syncEntity](f *FakeYNAB, items []T, since int64) []T {
+	result := make([]T, 0, len(items))
+	for _, it := range items {
+		if f.changed(it, since) {
+			result = append(result, it)
+		}
+	}
+	return result
+}
+
+func writeFakeError(w http.ResponseWriter, status int, name, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"id": strconv.Itoa(status), "name": name, "detail": detail},
+	})
+}
+
+func writeFakeData(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]any{"data": data})
+	if err != nil {
+		log.Printf("WARNING: fake YNAB: %v", err)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ExpenseForm holds the values shown in _form.html, either defaults for a new
+// entry or the current values of a transaction being edited.
+type ExpenseForm struct {
+	Action     string
+	Submit     string
+	Date       string
+	Amount     string
+	Currency   string
+	AccountID  string
+	CategoryID string
+	Payee      string
+	Comment    string
+	Splits     []SplitLine
+	SplitOpen  bool
+	Receipts   []string // names of the photos uploaded so far
+	Errors     map[string]string
+
+	// Token identifies this particular form submission (sent as YNAB import_id)
+	Token string
+	// Duplicate is a similar existing transaction the user must confirm past
+	Duplicate *YNABTransaction
+}
+
+func (app *App) newExpenseForm() *ExpenseForm {
+	return &ExpenseForm{
+		Action:   app.BasePath + "/enter",
+		Submit:   "Enter",
+		Date:     time.Now().Format("2006-01-02"),
+		Currency: app.DefaultCurrency.Code,
+		Splits:   padSplitLines(nil, 0),
+		Token:    newSubmissionToken(),
+	}
+}
+
+// withSubmitted returns a copy of the form showing the submitted values
+// together with the validation messages.
+func (f *ExpenseForm) withSubmitted(values url.Values, errors map[string]string) *ExpenseForm {
+	token := f.Token
+	if token != "" && values.Get("token") != "" {
+		token = values.Get("token")
+	}
+	result := &ExpenseForm{
+		Action:     f.Action,
+		Submit:     f.Submit,
+		Date:       values.Get("date"),
+		Amount:     values.Get("amount"),
+		Currency:   values.Get("currency"),
+		AccountID:  values.Get("account"),
+		CategoryID: values.Get("category"),
+		Payee:      values.Get("payee"),
+		Comment:    values.Get("comment"),
+		Receipts:   values["receipt_name"],
+		Errors:     errors,
+		Token:      token,
+	}
+	// Only new entries can be split, see handleEditExpense
+	if f.Splits != nil {
+		lines := parseSplitLines(values)
+		result.Splits = padSplitLines(lines, 1)
+		result.SplitOpen = len(lines) > 0
+	}
+	return result
+}
+
+// ValidationError reports problems with submitted form values that the user
+// can fix, keyed by form field name.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+// Add records a message for the field, keeping the first one if there are several.
+func (e *ValidationError) Add(field, message string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	if _, ok := e.Fields[field]; !ok {
+		e.Fields[field] = message
+	}
+}
+
+func (e *ValidationError) Error() string {
+	fields := slices.Sorted(maps.Keys(e.Fields))
+	msgs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, f+": "+e.Fields[f])
+	}
+	return "invalid form: " + strings.Join(msgs, "; ")
+}
+
+// maxPayeeNameLength is YNAB's limit on payee names
+const maxPayeeNameLength = 200
+
+const noRateMessage = "There's no usable exchange rate for this currency."
+
+// parseExpenseForm builds a transaction out of the submitted form fields,
+// converting the amount into the budget currency. Problems with the values
+// are reported as a *ValidationError.
+func (app *App) parseExpenseForm(data *YNABData, form url.Values) (*YNABTransaction, error) {
+	errs := &ValidationError{}
+
+	// Extract fields
+	dateStr := form.Get("date")
+	catID := form.Get("category")
+	accID := form.Get("account")
+	payeeName := strings.TrimSpace(form.Get("payee"))
+	comment := strings.TrimSpace(form.Get("comment"))
+	amountStr := strings.TrimSpace(form.Get("amount"))
+	currencyCode := form.Get("currency")
+
+	date := time.Now()
+	if dateStr == "" {
+		// default to today
+		dateStr = date.Format("2006-01-02")
+	} else if d, err := time.Parse("2006-01-02", dateStr); err != nil {
+		errs.Add("date", "Enter a valid date.")
+	} else {
+		date = d
+	}
+
+	currency := app.CurrenciesByCode[currencyCode]
+	if currency == nil {
+		errs.Add("currency", fmt.Sprintf("Unknown currency %q.", currencyCode))
+	}
+
+	splitLines := parseSplitLines(form)
+
+	var amount Amount
+	if amountStr == "" {
+		if len(splitLines) == 0 {
+			errs.Add("amount", "Enter an amount.")
+		}
+	} else if a, err := parseAmountIn(currency, amountStr); err != nil {
+		errs.Add("amount", "Enter a number like 12.50.")
+	} else {
+		amount = a
+	}
+
+	account := data.AccountByID(accID)
+	if account == nil {
+		errs.Add("account", "Choose an account.")
+	}
+
+	var category *YNABCategory
+	var subtransactions []*YNABSubtransaction
+	if len(splitLines) > 0 {
+		category = SplitCategory
+
+		var total Amount
+		for _, line := range splitLines {
+			field := fmt.Sprintf("split.%d", line.Index)
+			lineAmount, err := parseAmountIn(currency, line.Amount)
+			if err != nil {
+				errs.Add(field, "Enter a number like 12.50.")
+				continue
+			}
+			lineCategory := data.CategoryByID(line.CategoryID)
+			if line.CategoryID == "" {
+				errs.Add(field, "Choose a category.")
+				continue
+			} else if lineCategory == nil {
+				errs.Add(field, "This category is no longer available.")
+				continue
+			} else if lineCategory.IsTransferCategory() {
+				errs.Add(field, "Transfers can't be part of a split.")
+				continue
+			}
+			total += lineAmount
+			if currency == nil {
+				continue
+			}
+			subAmount, subComment, err := app.convertToBudget(lineAmount, currency, date, line.Comment)
+			if err != nil {
+				errs.Add("currency", noRateMessage)
+				continue
+			}
+			subtransactions = append(subtransactions, &YNABSubtransaction{
+				Category: lineCategory,
+				Comment:  subComment,
+				Amount:   -subAmount,
+			})
+		}
+		if amountStr == "" {
+			amount = total
+		} else if total != amount && errs.Fields["amount"] == "" && currency != nil {
+			errs.Add("amount", fmt.Sprintf("Split lines add up to %s, not %s.",
+				FormatAmount(total, currency, false), FormatAmount(amount, currency, false)))
+		}
+	} else {
+		category = data.CategoryByID(catID)
+		if catID == "" {
+			errs.Add("category", "Choose a category.")
+		} else if category == nil {
+			errs.Add("category", "This category is no longer available.")
+		}
+	}
+
+	if utf8.RuneCountInString(payeeName) > maxPayeeNameLength {
+		errs.Add("payee", fmt.Sprintf("Use at most %d characters.", maxPayeeNameLength))
+	}
+
+	if len(errs.Fields) > 0 {
+		return nil, errs
+	}
+
+	budgetAmount, comment, err := app.convertToBudget(amount, currency, date, comment)
+	if err != nil {
+		errs.Add("currency", noRateMessage)
+		return nil, errs
+	}
+	if len(subtransactions) > 0 {
+		// YNAB requires the parts to add up exactly, so the total is their
+		// sum rather than a separately rounded conversion.
+		budgetAmount = 0
+		for _, sub := range subtransactions {
+			budgetAmount -= sub.Amount
+		}
+	}
+
+	// Create transaction object; YNAB amounts are negative for outflows
+	tx := &YNABTransaction{
+		Date:            dateStr,
+		Category:        category,
+		Account:         account,
+		Comment:         comment,
+		Amount:          -budgetAmount,
+		Subtransactions: subtransactions,
+	}
+	if payee := data.PayeeByName(payeeName); payee != nil {
+		tx.PayeeID, tx.PayeeName = payee.ID, payee.Name
+	} else {
+		tx.PayeeName = payeeName
+	}
+
+	// Handle transfer-specific fields
+	if category.IsTransferCategory() {
+		tx.IsTransfer = true
+
+		// Find the target account for the transfer
+		targetID := category.TransferTargetID()
+		for _, a := range data.Accounts {
+			if a.ID == targetID {
+				tx.TransferAccount = a
+				break
+			}
+		}
+
+		// The payee of a transfer is the other account
+		tx.PayeeID, tx.PayeeName = "", ""
+
+		// Clean up transfer comments to prevent duplication
+		// If no comment provided for a transfer, leave it empty
+		// YNAB will automatically display it as a transfer
+		if comment == "" {
+			tx.Comment = ""
+		}
+	}
+	return tx, nil
+}
+
+// convertToBudget converts an amount entered in the given currency into the
+// budget currency at the rate of the given date, prefixing the comment with
+// the original amount and the rate used, e.g. "₾25 @2.6 Cat litter".
+func (app *App) convertToBudget(amount Amount, currency *Currency, date time.Time, comment string) (Amount, string, error) {
+	if currency == app.BudgetCurrency {
+		return amount, comment, nil
+	}
+
+	rate := app.Rate(currency, date)
+	amountComment := FormatAmount(amount, currency, true) + " @" + strconv.FormatFloat(rate, 'f', -1, 64)
+	if comment == "" {
+		comment = amountComment
+	} else {
+		comment = fmt.Sprintf("%s %s", amountComment, comment)
+	}
+
+	// Budget amounts are kept in whole cents
+	exact, err := app.convertExact(amount, currency, app.BudgetCurrency, date)
+	if err != nil {
+		return 0, "", err
+	}
+	return roundRat(exact, 10, app.BudgetCurrency.Rounding), comment, nil
+}
+
+// parseAmountIn parses the amount as written in the currency, if it's known
+func parseAmountIn(currency *Currency, s string) (Amount, error) {
+	if currency == nil {
+		return ParseAmount(s)
+	}
+	return currency.ParseAmount(s)
+}
+
+// AmountPattern is the pattern attribute of amount inputs, accepting digits
+// and the separators of every configured currency.
+func (app *App) AmountPattern() string {
+	var seps []rune
+	for _, c := range app.Currencies {
+		for _, r := range c.DecimalSeparator + c.GroupSeparator {
+			if !slices.Contains(seps, r) {
+				seps = append(seps, r)
+			}
+		}
+	}
+	if len(seps) == 0 {
+		return "[0-9]*"
+	}
+	return "[0-9]*([" + string(seps) + "][0-9]+)*"
+}
+
+// SplitLine is one row of the split section of the expense form
+type SplitLine struct {
+	Index      int
+	CategoryID string
+	Amount     string
+	Comment    string
+}
+
+// minSplitLines is how many split rows the form offers at the least
+const minSplitLines = 3
+
+// parseSplitLines returns the non-empty split rows of the submitted form
+func parseSplitLines(form url.Values) []SplitLine {
+	categories, amounts, comments := form["split_category"], form["split_amount"], form["split_comment"]
+	var result []SplitLine
+	for i := range max(len(categories), len(amounts), len(comments)) {
+		line := SplitLine{
+			Index:      i,
+			CategoryID: valueAt(categories, i),
+			Amount:     strings.TrimSpace(valueAt(amounts, i)),
+			Comment:    strings.TrimSpace(valueAt(comments, i)),
+		}
+		if line.Amount == "" && line.CategoryID == "" && line.Comment == "" {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func valueAt(values []string, i int) string {
+	if i < len(values) {
+		return values[i]
+	}
+	return ""
+}
+
+// padSplitLines keeps the submitted split rows in place (so that validation
+// messages line up) and adds empty rows for more parts.
+func padSplitLines(lines []SplitLine, extra int) []SplitLine {
+	n := extra
+	if len(lines) > 0 {
+		n += lines[len(lines)-1].Index + 1
+	}
+	n = max(n, minSplitLines)
+	result := make([]SplitLine, n)
+	for i := range result {
+		result[i].Index = i
+	}
+	for _, line := range lines {
+		result[line.Index] = line
+	}
+	return result
+}
+
+// editForm prefills the expense form with a transaction's current values.
+// Amounts entered in another currency are recognized by the memo prefix
+// that parseExpenseForm adds, so they can be edited in that currency.
+func (app *App) editForm(tx *YNABTransaction) *ExpenseForm {
+	form := &ExpenseForm{
+		Action:     app.BasePath + "/transactions/" + url.PathEscape(tx.ID),
+		Submit:     "Save",
+		Date:       tx.Date,
+		Amount:     formatAmountInput(-tx.Amount, app.BudgetCurrency),
+		Currency:   app.BudgetCurrency.Code,
+		AccountID:  tx.Account.ID,
+		CategoryID: tx.Category.ID,
+		Payee:      tx.PayeeName,
+		Comment:    withoutReceiptLinks(app.withoutAuthor(tx.Comment)),
+		Receipts:   app.receiptsOf(tx)[tx.ID],
+	}
+	if currency, amount, rest, ok := app.parseAmountComment(form.Comment); ok {
+		form.Currency = currency.Code
+		form.Amount = amount
+		form.Comment = rest
+	}
+	return form
+}
+
+// PayeeOption is a payee suggested in the form, with the account, category
+// and currency of the latest expense paid to it, which choosing the payee
+// fills in
+type PayeeOption struct {
+	Name       string
+	AccountID  string
+	CategoryID string // empty for splits
+	Currency   string
+}
+
+// payeeOptions lists the known payees by name. The defaults come from the
+// transactions, so they follow expenses entered in YNAB itself too.
+func (app *App) payeeOptions(data *YNABData) []*PayeeOption {
+	byName := make(map[string]*PayeeOption, len(data.Payees))
+	for _, p := range data.Payees {
+		byName[strings.ToLower(p.Name)] = &PayeeOption{Name: p.Name}
+	}
+	for _, tx := range data.Transactions {
+		if tx.PayeeName == "" {
+			continue
+		}
+		key := strings.ToLower(tx.PayeeName)
+		option := byName[key]
+		if option == nil {
+			option = &PayeeOption{Name: tx.PayeeName} // not synced yet
+			byName[key] = option
+		}
+		option.AccountID = tx.Account.ID
+		option.CategoryID = ""
+		if !tx.IsSplit() {
+			option.CategoryID = tx.Category.ID
+		}
+		option.Currency = app.BudgetCurrency.Code
+		if currency, _, _, ok := app.parseAmountComment(app.withoutAuthor(tx.Comment)); ok {
+			option.Currency = currency.Code
+		}
+	}
+	return slices.SortedFunc(maps.Values(byName), func(a, b *PayeeOption) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+}
+
+// parseAmountComment splits a memo like "₾25 @2.6 Cat litter" into the
+// currency, the amount and the rest of the comment. The rate is optional.
+// Amounts are matched as convertToBudget writes them, without grouping.
+func (app *App) parseAmountComment(comment string) (*Currency, string, string, bool) {
+	for _, c := range app.Currencies {
+		if c == app.BudgetCurrency {
+			continue
+		}
+		s, ok := strings.CutPrefix(comment, c.Prefix)
+		if !ok {
+			continue
+		}
+		n := strings.IndexFunc(s, func(r rune) bool {
+			return (r < '0' || r > '9') && string(r) != c.DecimalSeparator
+		})
+		if n < 0 {
+			n = len(s)
+		}
+		amount, s := s[:n], s[n:]
+		if _, err := ParseAmount(amount); err != nil {
+			continue
+		}
+		s, ok = strings.CutPrefix(s, c.Suffix)
+		if !ok || (s != "" && s[0] != ' ') {
+			continue
+		}
+		rest := strings.TrimPrefix(s, " ")
+		if rateWord, afterRate, _ := strings.Cut(rest, " "); strings.HasPrefix(rateWord, "@") {
+			if _, err := strconv.ParseFloat(rateWord[1:], 64); err == nil {
+				rest = afterRate
+			}
+		}
+		return c, amount, rest, true
+	}
+	return nil, "", "", false
+}
+
+func formatAmountInput(amount Amount, currency *Currency) string {
+	return strings.Replace(amount.Decimal(), ".", currency.DecimalSeparator, 1)
+}
@@ -5,3 +5,5 @@ go 1.23.3
 require github.com/andreyvit/mvp v0.3.30
 
 require github.com/andreyvit/jsonfix v1.1.0
+
+require golang.org/x/crypto v0.36.0
@@ -1,22 +1,19 @@
 package main
 
 import (
-	_ "embed"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/andreyvit/jsonfix"
 )
 
-//go:embed config.json
-var configJSON []byte
-
 type AppConfig struct {
 	YNABToken         string           `json:"ynabToken"`
+	YNABBaseURL       string           `json:"ynab_base_url"`
 	BudgetName        string           `json:"budget"`
+	BudgetID          string           `json:"budget_id"`    // an ID, last-used or default; the budget named above if empty
+	BudgetMatch       string           `json:"budget_match"` // how budget names match: exact (default) or loose, ignoring case and emoji
 	PageTitle         string           `json:"page_title"`
 	Categories        []string         `json:"categories"`
 	Accounts          []string         `json:"accounts"`
@@ -25,34 +22,139 @@ type AppConfig struct {
 	BudgetCurrency    string           `json:"budget_currency"`
 	DefaultCurrency   string           `json:"default_currency"`
 	SecondaryCurrency string           `json:"secondary_currency"`
+	RatesFile         string           `json:"rates_file"`     // CSV or JSON historical rates
+	ECBRatesFile      string           `json:"ecb_rates_file"` // ECB eurofxref XML feed
+	AuditLog          string           `json:"audit_log"`      // JSON Lines file of submissions and syncs
+	ReceiptsDir       string           `json:"receipts_dir"`   // where receipt photos are kept, disabled if empty
+	CacheDir          string           `json:"cache_dir"`      // where YNAB data is kept across restarts, disabled if empty
+	PublicURL         string           `json:"public_url"`     // like https://expenses.example.com, for links in memos
+	Presets           []PresetConfig   `json:"presets"`        // one-tap buttons above the form
+
+	// How often to sync with YNAB in the background, like "5m", plus a
+	// random delay of up to RefreshJitter; "0" syncs only as pages load
+	RefreshInterval string `json:"refresh_interval"`
+	RefreshJitter   string `json:"refresh_jitter"`
+
+	Users         []UserConfig     `json:"users"` // log in with these when set
+	SessionSecret string           `json:"session_secret"`
+	APITokens     []APITokenConfig `json:"api_tokens"` // for /api/v1/
+
+	// Profiles are extra forms served at /p/{name}/, each overriding any of
+	// the settings above
+	Profiles map[string]json.RawMessage `json:"profiles"`
 }
 
 type CurrencyConfig struct {
-	Code   string  `json:"code"`
-	Rate   float64 `json:"rate"`
-	Format string  `json:"format"`
+	Code     string  `json:"code"`
+	Rate     float64 `json:"rate"`
+	Format   string  `json:"format"`   // like "$9.99", used when there's no symbol
+	Rounding string  `json:"rounding"` // half-even (default), up or down
+
+	Decimals         *int   `json:"decimals"`          // default 2
+	DecimalSeparator string `json:"decimal_separator"` // dot (default) or comma
+	GroupSeparator   string `json:"group_separator"`   // none by default
+	Symbol           string `json:"symbol"`
+	SymbolPosition   string `json:"symbol_position"` // before (default) or after
+	SymbolSpace      bool   `json:"symbol_space"`    // put a space between symbol and number
+}
+
+// PresetConfig is a button above the form for an expense entered often.
+// With an amount, tapping it enters the expense; without, it fills the form.
+type PresetConfig struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Account  string `json:"account"`  // the first one if empty
+	Currency string `json:"currency"` // the default one if empty
+	Amount   string `json:"amount"`   // in the preset's currency, like "12.50"
+	Memo     string `json:"memo"`
+}
+
+// UserConfig is a login for the built-in authentication. Profiles are named
+// as in AppConfig.Profiles, with "default" for the top-level form.
+type UserConfig struct {
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"password_hash"` // bcrypt, e.g. from caddy hash-password
+	Profiles     []string `json:"profiles"`      // empty means all
+	Accounts     []string `json:"accounts"`      // empty means all of the profile's
+	Categories   []string `json:"categories"`    // empty means all of the profile's
 }
 
-var appCfg AppConfig
+type APITokenConfig struct {
+	Name      string `json:"name"`
+	TokenHash string `json:"token_sha256"` // hex, e.g. from printf %s "$TOKEN" | sha256sum
+	User      string `json:"user"`         // act with the permissions of this user, all if empty
+}
 
 func main() {
 	var addr = flag.String("listen", ":3000", "HTTP listen address")
+	var configPath = flag.String("config", "config.json", "config file, reloaded on SIGHUP")
+	var fakeYNAB = flag.Bool("fake-ynab", false, "run against an in-memory fake YNAB API")
 	flag.Parse()
 
-	err := json.Unmarshal(jsonfix.Bytes(configJSON), &appCfg)
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to parse config.json: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var fake *FakeYNAB
+	if *fakeYNAB {
+		fake = NewFakeYNAB(cfg.BudgetName)
+		defer fake.Close()
+		fake.Seed(cfg)
+		log.Printf("Using fake YNAB API at %s", fake.BaseURL())
+	}
+	build := func(cfg *AppConfig) (*appSet, error) {
+		if fake != nil {
+			cfg.YNABBaseURL = fake.BaseURL()
+			cfg.YNABToken = "fake"
+		}
+		return newAppSet(cfg)
 	}
 
-	app, err := New(&appCfg)
+	apps, err := build(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	currentApps.Store(apps)
+	go refreshPeriodically()
+	reloadOnSIGHUP(func() (*appSet, error) {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		return build(cfg)
+	})
 
-	http.HandleFunc("GET /{$}", wrap(app.handleIndex))
-	http.HandleFunc("POST /enter", wrap(app.handleEnterExpense))
-	http.HandleFunc("POST /refresh", wrap(app.handleRefresh))
+	registerRoutes(http.DefaultServeMux)
 
 	fmt.Printf("Listening on %s...\n", *addr)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
+
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /login", wrap(handleLoginPage))
+	mux.HandleFunc("POST /login", wrap(handleLogin))
+	mux.HandleFunc("POST /logout", wrap(handleLogout))
+	mux.HandleFunc("GET /static/{name...}", handleStatic)
+	for _, prefix := range []string{"", "/p/{profile}"} {
+		mux.HandleFunc("GET "+prefix+"/{$}", route((*App).handleIndex))
+		mux.HandleFunc("POST "+prefix+"/enter", route((*App).handleEnterExpense))
+		mux.HandleFunc("POST "+prefix+"/refresh", route((*App).handleRefresh))
+		mux.HandleFunc("GET "+prefix+"/transactions/{id}/edit", route((*App).handleEditExpense))
+		mux.HandleFunc("POST "+prefix+"/transactions/{id}", route((*App).handleUpdateExpense))
+		mux.HandleFunc("POST "+prefix+"/transactions/{id}/delete", route((*App).handleDeleteExpense))
+		mux.HandleFunc("GET "+prefix+"/audit", route((*App).handleAudit))
+		mux.HandleFunc("GET "+prefix+"/receipts/{name}", routePublic((*App).handleReceipt))
+		mux.HandleFunc("GET "+prefix+"/manifest.webmanifest", routePublic((*App).handleManifest))
+		mux.HandleFunc("GET "+prefix+"/sw.js", routePublic((*App).handleServiceWorker))
+		mux.HandleFunc("POST "+prefix+"/sync", route((*App).handleSync))
+
+		mux.HandleFunc("GET "+prefix+"/api/v1/accounts", routeAPI((*App).handleAPIAccounts))
+		mux.HandleFunc("GET "+prefix+"/api/v1/categories", routeAPI((*App).handleAPICategories))
+		mux.HandleFunc("GET "+prefix+"/api/v1/currencies", routeAPI((*App).handleAPICurrencies))
+		mux.HandleFunc("GET "+prefix+"/api/v1/transactions", routeAPI((*App).handleAPITransactions))
+		mux.HandleFunc("POST "+prefix+"/api/v1/transactions", routeAPI((*App).handleAPICreateTransaction))
+		mux.HandleFunc("PUT "+prefix+"/api/v1/transactions/{id}", routeAPI((*App).handleAPIUpdateTransaction))
+		mux.HandleFunc("DELETE "+prefix+"/api/v1/transactions/{id}", routeAPI((*App).handleAPIDeleteTransaction))
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"slices"
+	"strings"
+)
+
+// YNABData is a snapshot of a budget. Once handed out by the cache it's
+// never modified; changes are made to a clone, which then replaces it.
 type YNABData struct {
 	BudgetID     string
 	Accounts     []*YNABAccount
@@ -7,6 +14,42 @@ type YNABData struct {
 	Transactions []*YNABTransaction
 	// Combined list of real categories and transfer pseudo-categories
 	AllCategories []*YNABCategory
+	// Payees to choose from, without the transfer ones
+	Payees []*YNABPayee
+	// Raw YNAB state for incremental refreshes; nil for mock data
+	Sync *YNABSyncState
+}
+
+// clone returns a copy whose accounts, categories and lists can be changed
+// without affecting data. Transactions, payees and Sync are shared, since
+// changes replace them rather than modify them; transactions keep pointing
+// at the accounts and categories they were built with, so look those up in
+// the snapshot for current balances.
+func (data *YNABData) clone() *YNABData {
+	result := *data
+	result.Accounts = make([]*YNABAccount, len(data.Accounts))
+	for i, a := range data.Accounts {
+		copied := *a
+		result.Accounts[i] = &copied
+	}
+	categories := make(map[*YNABCategory]*YNABCategory, len(data.AllCategories))
+	copyCategory := func(c *YNABCategory) *YNABCategory {
+		if categories[c] == nil {
+			copied := *c
+			categories[c] = &copied
+		}
+		return categories[c]
+	}
+	result.Categories = make([]*YNABCategory, len(data.Categories))
+	for i, c := range data.Categories {
+		result.Categories[i] = copyCategory(c)
+	}
+	result.AllCategories = make([]*YNABCategory, len(data.AllCategories))
+	for i, c := range data.AllCategories {
+		result.AllCategories[i] = copyCategory(c)
+	}
+	result.Transactions = slices.Clone(data.Transactions)
+	return &result
 }
 
 func (data *YNABData) CategoryByID(id string) *YNABCategory {
@@ -36,6 +79,51 @@ func (data *YNABData) AccountByID(id string) *YNABAccount {
 	return nil
 }
 
+// PayeeByName finds a payee ignoring case, like YNAB does
+func (data *YNABData) PayeeByName(name string) *YNABPayee {
+	for _, p := range data.Payees {
+		if strings.EqualFold(p.Name, name) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (data *YNABData) TransactionByID(id string) *YNABTransaction {
+	if id == "" {
+		return nil
+	}
+	for _, t := range data.Transactions {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (data *YNABData) TransactionByImportID(importID string) *YNABTransaction {
+	if importID == "" {
+		return nil
+	}
+	for _, t := range data.Transactions {
+		if t.ImportID == importID {
+			return t
+		}
+	}
+	return nil
+}
+
+// SimilarTransaction returns an existing transaction with the same date,
+// amount, account and category as tx, if any.
+func (data *YNABData) SimilarTransaction(tx *YNABTransaction) *YNABTransaction {
+	for _, t := range data.Transactions {
+		if t.Date == tx.Date && t.Amount == tx.Amount && t.Account.ID == tx.Account.ID && t.Category.ID == tx.Category.ID {
+			return t
+		}
+	}
+	return nil
+}
+
 type YNABAccount struct {
 	ID              string `json:"id"`
 	Name            string `json:"name"`
@@ -53,6 +141,22 @@ type YNABCategory struct {
 	Name         string `json:"name"`
 	IsTransfer   bool   `json:"-"`
 	TransferToID string `json:"-"`
+
+	// The current month's figures; Balance is what's left to spend
+	Budgeted Amount `json:"budgeted"`
+	Activity Amount `json:"activity"`
+	Balance  Amount `json:"balance"`
+
+	GoalType               string `json:"goal_type,omitempty"` // empty if there's no goal
+	GoalTarget             Amount `json:"goal_target,omitempty"`
+	GoalTargetMonth        string `json:"goal_target_month,omitempty"`
+	GoalPercentageComplete int    `json:"goal_percentage_complete,omitempty"`
+	GoalUnderFunded        Amount `json:"goal_under_funded,omitempty"` // still to budget this month
+}
+
+type YNABCategoryViewModel struct {
+	*YNABCategory
+	SecondaryBalance *Monetary
 }
 
 // IsTransferCategory returns true if this is a transfer pseudo-category
@@ -65,18 +169,43 @@ func (c *YNABCategory) TransferTargetID() string {
 	return c.TransferToID
 }
 
+type YNABPayee struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
 type YNABTransaction struct {
 	ID              string
 	Date            string
 	Category        *YNABCategory
 	Account         *YNABAccount
 	TransferAccount *YNABAccount
-	Comment         string
-	Amount          Amount
-	AmountUSD       Amount
-	IsTransfer      bool
+	// Empty for transfers. A new payee has only a name until YNAB creates it.
+	PayeeID    string
+	PayeeName  string
+	Comment    string
+	Amount     Amount
+	AmountUSD  Amount
+	IsTransfer bool
+	ImportID   string
+	// Parts of a split transaction; Category is SplitCategory then
+	Subtransactions []*YNABSubtransaction
+}
+
+// IsSplit returns true if the transaction is split across several categories
+func (t *YNABTransaction) IsSplit() bool {
+	return len(t.Subtransactions) > 0
+}
+
+type YNABSubtransaction struct {
+	Category *YNABCategory // nil if not one of the configured categories
+	Comment  string
+	Amount   Amount
 }
 
+// SplitCategory is the pseudo-category of split transactions
+var SplitCategory = &YNABCategory{ID: "split", Name: "Split"}
+
 // GenerateTransferCategories creates pseudo-categories for transfers between accounts
 func GenerateTransferCategories(accounts []*YNABAccount) []*YNABCategory {
 	categories := make([]*YNABCategory, 0, len(accounts))
@@ -95,7 +224,13 @@ func GenerateTransferCategories(accounts []*YNABAccount) []*YNABCategory {
 }
 
 type Currency struct {
-	Code   string
-	Rate   float64
-	Format string
+	Code     string
+	Rate     float64
+	Prefix   string // symbol written before the number, with any spacing
+	Suffix   string // symbol written after the number, with any spacing
+	Rounding RoundingMode
+
+	Decimals         int // shown decimal places, 0 to 3
+	DecimalSeparator string
+	GroupSeparator   string
 }
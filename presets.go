@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	maxSuggestedPresets = 4
+	minSuggestionCount  = 3 // how many times an expense is entered before it's suggested
+)
+
+// Preset is a button above the form, either configured or suggested from
+// the expenses entered most often
+type Preset struct {
+	Name       string
+	AccountID  string
+	CategoryID string
+	Currency   string
+	Amount     string
+	Payee      string
+	Comment    string
+	Suggested  bool
+
+	// Submit means tapping the preset enters the expense, with the Token
+	// of its own form; otherwise it opens URL, the form filled in
+	Submit bool
+	Token  string
+	URL    string
+}
+
+// checkPreset validates a configured preset; currency is the one it's in,
+// nil if unknown
+func checkPreset(p PresetConfig, currency *Currency) error {
+	if p.Name == "" || p.Category == "" {
+		return errors.New("a preset needs a name and a category")
+	}
+	if currency == nil {
+		return fmt.Errorf("unknown currency %q", p.Currency)
+	}
+	if p.Amount != "" {
+		if _, err := parseAmountIn(currency, p.Amount); err != nil {
+			return fmt.Errorf("amount: %w", err)
+		}
+	}
+	return nil
+}
+
+// Values returns the form fields the preset fills in
+func (p *Preset) Values() url.Values {
+	values := url.Values{
+		"account":  {p.AccountID},
+		"category": {p.CategoryID},
+		"currency": {p.Currency},
+	}
+	for name, value := range map[string]string{"amount": p.Amount, "payee": p.Payee, "comment": p.Comment} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
+
+// presets returns the configured presets that the data has the category and
+// account of, followed by the suggested ones
+func (app *App) presets(data *YNABData, mock string) []*Preset {
+	var result []*Preset
+	for _, c := range app.Config.Presets {
+		categoryID := categoryIDByName(data, c.Category)
+		if data.CategoryByID(categoryID) == nil {
+			continue
+		}
+		accountID := accountIDByName(data, c.Account)
+		if c.Account == "" && len(data.Accounts) > 0 {
+			accountID = data.Accounts[0].ID
+		}
+		if data.AccountByID(accountID) == nil {
+			continue
+		}
+		result = append(result, &Preset{
+			Name:       c.Name,
+			AccountID:  accountID,
+			CategoryID: categoryID,
+			Currency:   cmp.Or(c.Currency, app.DefaultCurrency.Code),
+			Amount:     c.Amount,
+			Comment:    c.Memo,
+			Submit:     c.Amount != "",
+		})
+	}
+	result = append(result, app.suggestedPresets(data, result)...)
+
+	for _, p := range result {
+		if p.Submit {
+			p.Token = newSubmissionToken()
+			continue
+		}
+		values := p.Values()
+		if mock != "" {
+			values.Set("mock", mock)
+		}
+		p.URL = app.BasePath + "/?" + values.Encode()
+	}
+	return result
+}
+
+// suggestedPresets finds the expenses entered most often with the same
+// category and comment, other than the configured ones. They fill the form
+// with the latest amount, account and currency rather than entering it.
+func (app *App) suggestedPresets(data *YNABData, configured []*Preset) []*Preset {
+	type key struct {
+		categoryID, comment string
+	}
+	counts := make(map[key]int)
+	latest := make(map[key]*Preset)
+	for _, tx := range data.Transactions {
+		if tx.IsTransfer || tx.IsSplit() || tx.Category == nil {
+			continue
+		}
+		comment := withoutReceiptLinks(app.withoutAuthor(tx.Comment))
+		currency, amount := app.BudgetCurrency.Code, formatAmountInput(-tx.Amount, app.BudgetCurrency)
+		if c, a, rest, ok := app.parseAmountComment(comment); ok {
+			currency, amount, comment = c.Code, a, rest
+		}
+		k := key{tx.Category.ID, comment}
+		counts[k]++
+		latest[k] = &Preset{
+			Name:       cmp.Or(comment, tx.Category.Name),
+			AccountID:  tx.Account.ID,
+			CategoryID: tx.Category.ID,
+			Currency:   currency,
+			Amount:     amount,
+			Payee:      tx.PayeeName,
+			Comment:    comment,
+			Suggested:  true,
+		}
+	}
+	for _, p := range configured {
+		delete(counts, key{p.CategoryID, p.Comment})
+	}
+
+	keys := make([]key, 0, len(counts))
+	for k, n := range counts {
+		if n >= minSuggestionCount {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, func(a, b key) int {
+		return cmp.Or(
+			cmp.Compare(counts[b], counts[a]),
+			strings.Compare(latest[a].Name, latest[b].Name),
+		)
+	})
+
+	var result []*Preset
+	for _, k := range keys[:min(len(keys), maxSuggestedPresets)] {
+		result = append(result, latest[k])
+	}
+	return result
+}
+
+// prefill sets the fields given in the query, as preset links do
+func (f *ExpenseForm) prefill(query url.Values) {
+	fields := map[string]*string{
+		"amount":   &f.Amount,
+		"currency": &f.Currency,
+		"account":  &f.AccountID,
+		"category": &f.CategoryID,
+		"payee":    &f.Payee,
+		"comment":  &f.Comment,
+	}
+	for name, field := range fields {
+		if v := query.Get(name); v != "" {
+			*field = v
+		}
+	}
+}
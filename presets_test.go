@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.Config.Presets = []PresetConfig{
+		{Name: "Lunch", Category: "Dining Out", Currency: "GEL", Amount: "25", Memo: "Lunch"},
+		{Name: "Snacks", Category: "groceries", Account: "Held By Assistant"},
+		{Name: "Gone", Category: "Old Category"},
+	}
+
+	presets := app.presets(mustLoadData(t, app), "")
+	if len(presets) != 2 {
+		t.Fatalf("presets = %+v", presets)
+	}
+	lunch, snacks := presets[0], presets[1]
+	if !lunch.Submit || lunch.Token == "" || lunch.AccountID != "A1" || lunch.CategoryID != "C2" {
+		t.Errorf("Lunch = %+v", lunch)
+	}
+	if snacks.Submit || snacks.URL != "/?account=A2&category=C1&currency=GEL" {
+		t.Errorf("Snacks = %+v", snacks)
+	}
+
+	body := getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, "Lunch · 25 GEL") || !strings.Contains(body, `href="/?account=A2&amp;category=C1&amp;currency=GEL"`) {
+		t.Errorf("Expected the preset buttons in the page")
+	}
+
+	// Tapping Lunch enters it like the form does, and tapping twice doesn't
+	// enter it twice
+	form := lunch.Values()
+	form.Set("token", lunch.Token)
+	for range 2 {
+		if w := postForm(t, app.handleEnterExpense, "/enter", "", form); w.Code != http.StatusSeeOther {
+			t.Fatalf("Expected 303, got %d", w.Code)
+		}
+	}
+	var lunches int
+	for _, tx := range mustLoadData(t, app).Transactions {
+		if strings.HasSuffix(tx.Comment, "Lunch") {
+			lunches++
+		}
+	}
+	if lunches != 1 {
+		t.Errorf("Expected one lunch, got %d", lunches)
+	}
+
+	// Filling in the form from a link
+	body = getPage(t, app.handleIndex, "/?category=C2&amount=7&comment=Tea", "")
+	if !strings.Contains(body, `value="7"`) || !strings.Contains(body, `value="Tea"`) || !strings.Contains(body, `<option value="C2" data-name="Dining Out" selected>`) {
+		t.Errorf("Expected the form filled in from the query")
+	}
+}
+
+func TestPresets_suggested(t *testing.T) {
+	app := newFakeYNABApp(t)
+	for _, date := range []string{"2025-02-01", "2025-02-02", "2025-02-03"} {
+		postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+			"date":     {date},
+			"amount":   {"1"},
+			"currency": {"GEL"},
+			"account":  {"A2"},
+			"category": {"C2"},
+			"comment":  {"Bus fare"},
+		})
+	}
+
+	presets := app.presets(mustLoadData(t, app), "")
+	if len(presets) != 1 {
+		t.Fatalf("presets = %+v", presets)
+	}
+	bus := presets[0]
+	if !bus.Suggested || bus.Submit || bus.Name != "Bus fare" || bus.Currency != "GEL" || bus.Amount != "1" || bus.AccountID != "A2" {
+		t.Errorf("suggested = %+v", bus)
+	}
+
+	// A configured preset for the same expense replaces the suggestion
+	app.Config.Presets = []PresetConfig{{Name: "Bus", Category: "Dining Out", Currency: "GEL", Amount: "1", Memo: "Bus fare"}}
+	presets = app.presets(mustLoadData(t, app), "")
+	if len(presets) != 1 || presets[0].Suggested {
+		t.Errorf("presets = %+v", presets)
+	}
+}
+
+func mustLoadData(t *testing.T, app *App) *YNABData {
+	t.Helper()
+	data, err := app.loadData(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
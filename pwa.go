@@ -0,0 +1,123 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// staticFS holds the styles, scripts and icons served under /static/
+//
+//go:embed static
+var staticFS embed.FS
+
+type webManifest struct {
+	Name            string            `json:"name"`
+	ShortName       string            `json:"short_name"`
+	StartURL        string            `json:"start_url"`
+	Scope           string            `json:"scope"`
+	Display         string            `json:"display"`
+	BackgroundColor string            `json:"background_color"`
+	ThemeColor      string            `json:"theme_color"`
+	Icons           []webManifestIcon `json:"icons"`
+}
+
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// handleManifest serves the web app manifest that makes each profile's form
+// installable on its own
+func (app *App) handleManifest(w http.ResponseWriter, r *http.Request) error {
+	writeJSON(w, http.StatusOK, &webManifest{
+		Name:            app.Config.PageTitle,
+		ShortName:       app.Config.PageTitle,
+		StartURL:        app.BasePath + "/",
+		Scope:           app.BasePath + "/",
+		Display:         "standalone",
+		BackgroundColor: "#f9fafb",
+		ThemeColor:      "#2563eb",
+		Icons: []webManifestIcon{
+			{Src: assets.URL("icon-192.png"), Sizes: "192x192", Type: "image/png"},
+			{Src: assets.URL("icon-512.png"), Sizes: "512x512", Type: "image/png"},
+		},
+	})
+	return nil
+}
+
+// handleServiceWorker serves the service worker from the profile's path,
+// since a worker only controls the pages under its own path
+func (app *App) handleServiceWorker(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFileFS(w, r, staticFS, "static/sw.js")
+	return nil
+}
+
+// syncResult is the JSON response of /sync
+type syncResult struct {
+	Status        string            `json:"status"` // entered, replayed, duplicate or invalid
+	TransactionID string            `json:"transaction_id,omitempty"`
+	Message       string            `json:"message,omitempty"`
+	Errors        map[string]string `json:"errors,omitempty"`
+}
+
+// handleSync enters an expense queued while offline. It takes the same form
+// as /enter but answers in JSON, for the page's script to update its queue.
+// The token is required, so that sending an entry again can't enter it twice.
+func (app *App) handleSync(w http.ResponseWriter, r *http.Request) error {
+	err := parseRequestForm(w, r)
+	if err != nil {
+		return err
+	}
+	if r.Form.Get("token") == "" {
+		writeJSON(w, http.StatusBadRequest, &syncResult{Status: "invalid", Message: "The token is missing."})
+		return nil
+	}
+
+	mock := r.FormValue("mock")
+
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+
+	var tx *YNABTransaction
+	err = app.saveReceipts(r)
+	if err == nil {
+		tx, err = app.parseExpenseForm(data, r.Form)
+	}
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "enter", Outcome: auditInvalid, Error: verr.Error()})
+		writeJSON(w, http.StatusUnprocessableEntity, &syncResult{
+			Status:  "invalid",
+			Message: "Not entered: " + verr.Error(),
+			Errors:  verr.Fields,
+		})
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	result, err := app.enterTransaction(r, data, tx, mock)
+	if err != nil {
+		return err
+	}
+	switch {
+	case result.Duplicate != nil:
+		dup := result.Duplicate
+		writeJSON(w, http.StatusConflict, &syncResult{
+			Status: "duplicate",
+			Message: fmt.Sprintf("A %s expense of %s on %s from %s is already entered.",
+				dup.Category.Name, FormatAmount(-dup.Amount, app.BudgetCurrency, false), dup.Date, dup.Account.Name),
+			TransactionID: dup.ID,
+		})
+	case result.Replayed:
+		writeJSON(w, http.StatusOK, &syncResult{Status: "replayed", TransactionID: result.TxID})
+	default:
+		writeJSON(w, http.StatusOK, &syncResult{Status: "entered", TransactionID: result.TxID})
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	sync := func(form url.Values) (int, *syncResult) {
+		t.Helper()
+		w := postForm(t, app.handleSync, "/sync", "", form)
+		result := &syncResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatalf("%v in %s", err, w.Body)
+		}
+		return w.Code, result
+	}
+	form := url.Values{
+		"date":     {"2025-02-01"},
+		"amount":   {"25"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C2"},
+		"comment":  {"Market"},
+		"token":    {"queued1"},
+	}
+
+	code, entered := sync(form)
+	if code != http.StatusOK || entered.Status != "entered" || entered.TransactionID == "" {
+		t.Fatalf("first sync: %d %+v", code, entered)
+	}
+	// The page may send the entry again if the response got lost
+	if code, result := sync(form); code != http.StatusOK || result.Status != "replayed" || result.TransactionID != entered.TransactionID {
+		t.Errorf("second sync: %d %+v", code, result)
+	}
+
+	form.Set("token", "queued2")
+	if code, result := sync(form); code != http.StatusConflict || result.Status != "duplicate" || !strings.Contains(result.Message, "$10.00") {
+		t.Errorf("similar entry: %d %+v", code, result)
+	}
+	form.Set("allow_duplicate", "1")
+	if code, result := sync(form); code != http.StatusOK || result.Status != "entered" {
+		t.Errorf("confirmed entry: %d %+v", code, result)
+	}
+
+	form.Set("token", "queued3")
+	form.Set("amount", "lots")
+	if code, result := sync(form); code != http.StatusUnprocessableEntity || result.Status != "invalid" || result.Errors["amount"] == "" {
+		t.Errorf("invalid entry: %d %+v", code, result)
+	}
+
+	form.Del("token")
+	if code, result := sync(form); code != http.StatusBadRequest || result.Status != "invalid" {
+		t.Errorf("no token: %d %+v", code, result)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.BasePath = "/p/pets"
+
+	manifest := &webManifest{}
+	if err := json.Unmarshal([]byte(getPage(t, app.handleManifest, "/p/pets/manifest.webmanifest", "")), manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "Test Expenses" || manifest.StartURL != "/p/pets/" || manifest.Scope != "/p/pets/" || len(manifest.Icons) != 2 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	body := getPage(t, app.handleIndex, "/p/pets/", "")
+	if !strings.Contains(body, `href="/p/pets/manifest.webmanifest"`) || !strings.Contains(body, `data-offline-queue="/p/pets"`) {
+		t.Errorf("Expected the page to link the manifest and mark the form for offline entry")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreyvit/mvp/httpcall"
+)
+
+// YNAB allows 200 requests an hour per token, and says how many have been
+// made so far in the X-Rate-Limit header of each response, like "36/200".
+const (
+	rateLimitWindow  = time.Hour
+	rateLimitReserve = 20 // requests kept for entering expenses once refreshes stop
+
+	maxYNABAttempts = 3
+	ynabRetryDelay  = time.Second      // doubled after each attempt
+	maxRetryAfter   = 30 * time.Second // a longer Retry-After fails the request instead
+)
+
+// rateBudget is what YNAB last said about a token's requests
+type rateBudget struct {
+	Used    int
+	Limit   int
+	Updated time.Time
+}
+
+var (
+	rateBudgets    = make(map[string]rateBudget) // by tokenKey
+	rateBudgetsMut sync.Mutex
+)
+
+// tokenKey identifies a token without keeping it around
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ynabRequestsLeft estimates how many requests the token has left, or -1 if
+// YNAB hasn't said in the last hour
+func ynabRequestsLeft(token string) int {
+	rateBudgetsMut.Lock()
+	defer rateBudgetsMut.Unlock()
+	b, ok := rateBudgets[tokenKey(token)]
+	if !ok || time.Since(b.Updated) > rateLimitWindow {
+		return -1
+	}
+	return max(0, b.Limit-b.Used)
+}
+
+// ynabBudgetLow reports whether refreshes should wait, leaving the requests
+// that are left for entering expenses
+func ynabBudgetLow(token string) bool {
+	left := ynabRequestsLeft(token)
+	return left >= 0 && left < rateLimitReserve
+}
+
+func recordRateLimit(token string, used, limit int) {
+	rateBudgetsMut.Lock()
+	defer rateBudgetsMut.Unlock()
+	rateBudgets[tokenKey(token)] = rateBudget{Used: used, Limit: limit, Updated: time.Now()}
+}
+
+// parseRateLimit parses X-Rate-Limit, like "36/200"
+func parseRateLimit(s string) (used, limit int, err error) {
+	u, l, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", s)
+	}
+	used, err1 := strconv.Atoi(u)
+	limit, err2 := strconv.Atoi(l)
+	if err := errors.Join(err1, err2); err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", s)
+	}
+	return used, limit, nil
+}
+
+// isRateLimited reports whether err comes from YNAB turning a request away
+// for going over the rate limit
+func isRateLimited(err error) bool {
+	var callErr *httpcall.Error
+	return errors.As(err, &callErr) && callErr.StatusCode == http.StatusTooManyRequests
+}
+
+// ynabTransport records the rate limit of the token it's for, and retries
+// requests that YNAB turned away, or failed on when it's safe to repeat them
+type ynabTransport struct {
+	token string
+	base  http.RoundTripper // http.DefaultTransport if nil
+}
+
+func ynabClient(token string) *http.Client {
+	return &http.Client{Transport: &ynabTransport{token: token}}
+}
+
+func (t *ynabTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	delay := ynabRetryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := base.RoundTrip(req)
+		if resp != nil {
+			t.record(resp)
+		}
+		wait, retry := retryAfter(req, resp, err, delay)
+		if !retry || attempt >= maxYNABAttempts || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+func (t *ynabTransport) record(resp *http.Response) {
+	used, limit, err := parseRateLimit(resp.Header.Get("X-Rate-Limit"))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if err != nil {
+			limit = 200
+		}
+		recordRateLimit(t.token, limit, limit)
+	} else if err == nil {
+		recordRateLimit(t.token, used, limit)
+	}
+}
+
+// retryAfter decides whether to repeat a request and how long to wait first,
+// following Retry-After if given. Requests turned away with 429 weren't
+// processed, so any can be repeated; after a network error or a 5xx, only
+// those that don't create anything.
+func retryAfter(req *http.Request, resp *http.Response, err error, delay time.Duration) (time.Duration, bool) {
+	var retry bool
+	switch idempotent := req.Method != http.MethodPost; {
+	case err != nil:
+		return delay, idempotent && req.Context().Err() == nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retry = true
+	case resp.StatusCode >= 500:
+		retry = idempotent
+	}
+	if !retry {
+		return 0, false
+	}
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || time.Duration(seconds)*time.Second > maxRetryAfter {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return delay, true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input       string
+		used, limit int
+		wantErr     bool
+	}{
+		{"36/200", 36, 200, false},
+		{" 0/200 ", 0, 200, false},
+		{"", 0, 0, true},
+		{"36", 0, 0, true},
+		{"a/200", 0, 0, true},
+		{"1/0", 0, 0, true},
+	}
+	for _, tt := range tests {
+		used, limit, err := parseRateLimit(tt.input)
+		if (err != nil) != tt.wantErr || used != tt.used || limit != tt.limit {
+			t.Errorf("parseRateLimit(%q) = %d, %d, %v", tt.input, used, limit, err)
+		}
+	}
+}
+
+func TestYNABTransport_retries(t *testing.T) {
+	var calls atomic.Int32
+	var failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("X-Rate-Limit", "7/200")
+	}))
+	defer srv.Close()
+	client := ynabClient("transport-test-token")
+	t.Cleanup(func() { forgetRateLimit("transport-test-token") })
+
+	do := func(method string) int {
+		t.Helper()
+		calls.Store(0)
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader("{}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	failures = 2
+	if status := do(http.MethodGet); status != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("GET: %d after %d calls", status, calls.Load())
+	}
+	if left := ynabRequestsLeft("transport-test-token"); left != 193 {
+		t.Errorf("requests left = %d", left)
+	}
+	if status := do(http.MethodPut); status != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("PUT: %d after %d calls", status, calls.Load())
+	}
+
+	// A POST that failed may have created something, so it's not repeated
+	if status := do(http.MethodPost); status != http.StatusBadGateway || calls.Load() != 1 {
+		t.Errorf("POST: %d after %d calls", status, calls.Load())
+	}
+
+	failures = maxYNABAttempts
+	if status := do(http.MethodGet); status != http.StatusBadGateway || calls.Load() != maxYNABAttempts {
+		t.Errorf("GET: %d after %d calls", status, calls.Load())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	fake, cfg := newSeededFakeYNAB(t)
+	cfg.YNABToken = "rate-limit-test-token"
+	cfg.Currencies = []CurrencyConfig{{Code: "USD", Rate: 1.0, Format: "$9.99"}}
+	cfg.BudgetCurrency = "USD"
+	cfg.DefaultCurrency = "USD"
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearCache()
+	t.Cleanup(clearCache)
+	t.Cleanup(func() { forgetRateLimit(cfg.YNABToken) })
+
+	fake.SetRateLimit(0, 200)
+	getPage(t, app.handleIndex, "/", "")
+	if left := ynabRequestsLeft(cfg.YNABToken); left != 195 {
+		t.Fatalf("Expected 195 requests left after a full load, got %d", left)
+	}
+
+	// With few requests left, refreshing shows the data there is
+	fake.SetRateLimit(190, 200)
+	app.cache().expire()
+	getPage(t, app.handleIndex, "/", "")
+	fake.Requests()
+	postForm(t, app.handleRefresh, "/refresh", "", nil)
+	body := getPage(t, app.handleIndex, "/", "")
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no YNAB requests while the budget is low, got %v", requests)
+	}
+	if !strings.Contains(body, "YNAB rate limited, showing data from less than a minute ago.") {
+		t.Errorf("Expected the rate limit banner")
+	}
+
+	// Turned away by YNAB, the page shows the data there is too
+	forgetRateLimit(cfg.YNABToken)
+	fake.SetRateLimit(200, 200)
+	body = getPage(t, app.handleIndex, "/", "")
+	if requests := fake.Requests(); len(requests) != maxYNABAttempts {
+		t.Errorf("Expected the rate limited request to be retried, got %v", requests)
+	}
+	if !strings.Contains(body, "YNAB rate limited") {
+		t.Errorf("Expected the rate limit banner")
+	}
+
+	// With no data to show, it's an error
+	clearCache()
+	w := httptest.NewRecorder()
+	wrap(app.handleIndex)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+
+	// Once YNAB answers again and the backoff is over, the banner goes away
+	fake.SetRateLimit(0, 200)
+	endBackoff(app.cache())
+	if body := getPage(t, app.handleIndex, "/", ""); strings.Contains(body, "YNAB rate limited") {
+		t.Errorf("Expected no banner")
+	}
+}
+
+func forgetRateLimit(token string) {
+	rateBudgetsMut.Lock()
+	defer rateBudgetsMut.Unlock()
+	delete(rateBudgets, tokenKey(token))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateStore holds historical exchange rates, expressed like Currency.Rate:
+// units of the currency per one unit of the budget currency.
+type RateStore struct {
+	rates map[string][]datedRate // by currency code, sorted by date
+}
+
+type datedRate struct {
+	Date string // 2006-01-02
+	Rate float64
+}
+
+func NewRateStore() *RateStore {
+	return &RateStore{rates: make(map[string][]datedRate)}
+}
+
+// Add records the rate of the currency on the given date, replacing any
+// rate already known for that date.
+func (s *RateStore) Add(code, date string, rate float64) {
+	list := s.rates[code]
+	i, found := slices.BinarySearchFunc(list, date, func(r datedRate, d string) int {
+		return strings.Compare(r.Date, d)
+	})
+	if found {
+		list[i].Rate = rate
+	} else {
+		s.rates[code] = slices.Insert(list, i, datedRate{date, rate})
+	}
+}
+
+// Lookup returns the rate of the currency on the given date, falling back to
+// the nearest earlier date that has one.
+func (s *RateStore) Lookup(code string, date time.Time) (float64, bool) {
+	list := s.rates[code]
+	d := date.Format("2006-01-02")
+	i, found := slices.BinarySearchFunc(list, d, func(r datedRate, d string) int {
+		return strings.Compare(r.Date, d)
+	})
+	if found {
+		return list[i].Rate, true
+	} else if i > 0 {
+		return list[i-1].Rate, true
+	}
+	return 0, false
+}
+
+// LoadRatesFile loads rates from a CSV file with date,currency,rate rows, or
+// from a JSON file shaped like {"GEL": {"2025-01-31": 2.81}}.
+func (s *RateStore) LoadRatesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = s.loadJSON(f)
+	case ".csv":
+		err = s.loadCSV(f)
+	default:
+		err = errors.New("unsupported format, expected .csv or .json")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *RateStore) loadJSON(r io.Reader) error {
+	var byCurrency map[string]map[string]float64
+	if err := json.NewDecoder(r).Decode(&byCurrency); err != nil {
+		return err
+	}
+	for code, byDate := range byCurrency {
+		for date, rate := range byDate {
+			if err := s.addChecked(code, date, rate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RateStore) loadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	for i, rec := range records {
+		if i == 0 && strings.EqualFold(rec[0], "date") {
+			continue // header
+		}
+		rate, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid rate %q", i+1, rec[2])
+		}
+		if err := s.addChecked(rec[1], rec[0], rate); err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *RateStore) addChecked(code, date string, rate float64) error {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return fmt.Errorf("invalid date %q", date)
+	}
+	if !validRate(rate) {
+		return fmt.Errorf("invalid rate %v for %s on %s", rate, code, date)
+	}
+	s.Add(strings.ToUpper(code), date, rate)
+	return nil
+}
+
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string  `xml:"currency,attr"`
+			Rate     float64 `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// LoadECBFile loads an ECB euro reference rates feed (eurofxref-daily.xml or
+// eurofxref-hist.xml), re-expressing EUR-based rates against the budget
+// currency.
+func (s *RateStore) LoadECBFile(path string, budgetCode string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var env ecbEnvelope
+	if err := xml.Unmarshal(raw, &env); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, day := range env.Days {
+		perEUR := map[string]float64{"EUR": 1}
+		for _, r := range day.Rates {
+			perEUR[r.Currency] = r.Rate
+		}
+		budgetPerEUR := perEUR[budgetCode]
+		if budgetPerEUR == 0 {
+			continue
+		}
+		for code, rate := range perEUR {
+			if code != budgetCode && rate > 0 {
+				if err := s.addChecked(code, day.Time, rate/budgetPerEUR); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRateStore_Lookup(t *testing.T) {
+	s := NewRateStore()
+	s.Add("GEL", "2025-01-10", 2.8)
+	s.Add("GEL", "2025-01-01", 2.7)
+	s.Add("GEL", "2025-01-20", 2.9)
+	s.Add("GEL", "2025-01-10", 2.85)
+
+	tests := []struct {
+		date string
+		rate float64
+		ok   bool
+	}{
+		{"2024-12-31", 0, false},
+		{"2025-01-01", 2.7, true},
+		{"2025-01-09", 2.7, true},
+		{"2025-01-10", 2.85, true},
+		{"2025-01-19", 2.85, true},
+		{"2025-03-01", 2.9, true},
+	}
+	for _, tt := range tests {
+		rate, ok := s.Lookup("GEL", day(tt.date))
+		if rate != tt.rate || ok != tt.ok {
+			t.Errorf("Lookup(GEL, %s) = %v, %v, wanted %v, %v", tt.date, rate, ok, tt.rate, tt.ok)
+		}
+	}
+	if _, ok := s.Lookup("EUR", day("2025-01-10")); ok {
+		t.Errorf("Expected no EUR rate")
+	}
+}
+
+func TestRateStore_LoadFiles(t *testing.T) {
+	s := NewRateStore()
+	err := s.LoadRatesFile(writeTempFile(t, "rates.csv", "date,currency,rate\n2025-01-01, GEL, 2.7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.LoadRatesFile(writeTempFile(t, "rates.json", `{"gel": {"2025-02-01": 2.75}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.LoadECBFile(writeTempFile(t, "eurofxref-hist.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2025-03-03">
+			<Cube currency="USD" rate="1.25"/>
+			<Cube currency="GEL" rate="3.5"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`), "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for date, expected := range map[string]float64{"2025-01-15": 2.7, "2025-02-15": 2.75, "2025-03-03": 2.8} {
+		if rate, _ := s.Lookup("GEL", day(date)); rate != expected {
+			t.Errorf("GEL on %s = %v, wanted %v", date, rate, expected)
+		}
+	}
+	if rate, _ := s.Lookup("EUR", day("2025-03-03")); rate != 0.8 {
+		t.Errorf("EUR on 2025-03-03 = %v, wanted 0.8", rate)
+	}
+
+	if err := s.LoadRatesFile(writeTempFile(t, "bad.csv", "2025-13-01,GEL,2.7\n")); err == nil {
+		t.Errorf("Expected error for an invalid date")
+	}
+}
+
+func TestConvertAmount_historicalRates(t *testing.T) {
+	app, err := New(&AppConfig{
+		Currencies: []CurrencyConfig{
+			{Code: "USD", Rate: 1.0, Format: "$9.99"},
+			{Code: "GEL", Rate: 2.5, Format: "₾9.99"},
+		},
+		BudgetCurrency:  "USD",
+		DefaultCurrency: "GEL",
+		RatesFile:       writeTempFile(t, "rates.csv", "2025-01-01,GEL,2.0\n2025-02-01,GEL,4.0\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd, gel := app.CurrenciesByCode["USD"], app.CurrenciesByCode["GEL"]
+
+	tests := []struct {
+		date     string
+		expected Amount
+	}{
+		{"2024-12-31", 4_000}, // configured rate
+		{"2025-01-15", 5_000},
+		{"2025-02-01", 2_500},
+	}
+	for _, tt := range tests {
+		if a, err := app.ConvertAmount(10_000, gel, usd, day(tt.date)); err != nil || a != tt.expected {
+			t.Errorf("₾10 on %s = %v, %v, wanted %v", tt.date, a, err, tt.expected)
+		}
+	}
+
+	_, comment, err := app.convertToBudget(10_000, gel, day("2025-01-15"), "Lunch")
+	if err != nil || comment != "₾10 @2 Lunch" {
+		t.Errorf("comment = %q, %v", comment, err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	maxReceiptSize = 20 << 20 // per request
+	thumbnailSize  = 240      // pixels along the longer side
+
+	// maxThumbnailPixels covers phone cameras; a larger image, which may
+	// just claim a size it can't decode to, is saved without a thumbnail
+	maxThumbnailPixels = 50_000_000
+)
+
+// receiptTypes are the accepted image types and the extensions they are saved with
+var receiptTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// receiptNameRe matches receipt names: a hash of the content and an extension
+var receiptNameRe = regexp.MustCompile(`^[0-9a-f]{24}\.(jpg|png|gif|webp)$`)
+
+// receiptLinkRe matches the receipt links that withReceiptLinks adds to memos
+var receiptLinkRe = regexp.MustCompile(`\s*https?://\S+/receipts/[0-9a-f]{24}\.(jpg|png|gif|webp)`)
+
+var errNotAnImage = errors.New("not a JPEG, PNG, GIF or WebP photo")
+
+// ReceiptStore keeps receipt images on disk under names derived from their
+// content, and remembers which transactions they belong to.
+type ReceiptStore struct {
+	dir  string
+	mut  sync.Mutex
+	byTx map[string][]string // nil until links.jsonl is read
+}
+
+// receiptLink is a line of links.jsonl; later lines replace earlier ones
+type receiptLink struct {
+	TransactionID string   `json:"transaction_id"`
+	Receipts      []string `json:"receipts"`
+}
+
+var (
+	receiptStores    = make(map[string]*ReceiptStore) // by directory, shared between profiles
+	receiptStoresMut sync.Mutex
+)
+
+// openReceiptStore returns the store in the directory, or nil if dir is empty
+func openReceiptStore(dir string) *ReceiptStore {
+	if dir == "" {
+		return nil
+	}
+	receiptStoresMut.Lock()
+	defer receiptStoresMut.Unlock()
+	s := receiptStores[dir]
+	if s == nil {
+		s = &ReceiptStore{dir: dir}
+		receiptStores[dir] = s
+	}
+	return s
+}
+
+// path returns where the receipt is stored, like dir/ab/abcdef....jpg
+func (s *ReceiptStore) path(name string) string {
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *ReceiptStore) thumbnailPath(name string) string {
+	return strings.TrimSuffix(s.path(name), filepath.Ext(name)) + ".thumb.jpg"
+}
+
+// Exists reports whether the name refers to a stored receipt
+func (s *ReceiptStore) Exists(name string) bool {
+	if !receiptNameRe.MatchString(name) {
+		return false
+	}
+	_, err := os.Stat(s.path(name))
+	return err == nil
+}
+
+// Save stores the image and returns its name. Saving the same image again
+// returns the same name.
+func (s *ReceiptStore) Save(r io.Reader) (string, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	ext := receiptTypes[http.DetectContentType(raw)]
+	if ext == "" {
+		return "", errNotAnImage
+	}
+	sum := sha256.Sum256(raw)
+	name := hex.EncodeToString(sum[:12]) + ext
+
+	path := s.path(name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+	if err := writeFileAtomic(path, raw); err != nil {
+		return "", err
+	}
+
+	// Thumbnails are best effort; WebP can't be decoded by the standard library
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(raw)); err != nil || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return name, nil
+	}
+	if img, _, err := image.Decode(bytes.NewReader(raw)); err == nil {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80}); err == nil {
+			if err := writeFileAtomic(s.thumbnailPath(name), buf.Bytes()); err != nil {
+				return "", err
+			}
+		}
+	}
+	return name, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Link records that the receipts belong to the transaction, replacing the
+// ones linked before
+func (s *ReceiptStore) Link(txID string, names []string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if err := s.loadLinksLocked(); err != nil {
+		return err
+	}
+	if slices.Equal(s.byTx[txID], names) {
+		return nil
+	}
+	line, err := json.Marshal(receiptLink{TransactionID: txID, Receipts: names})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, "links.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.byTx[txID] = slices.Clone(names)
+	return nil
+}
+
+// ForTransactions returns the receipt names of each of the transactions
+func (s *ReceiptStore) ForTransactions(txs []*YNABTransaction) (map[string][]string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if err := s.loadLinksLocked(); err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string)
+	for _, tx := range txs {
+		if names := s.byTx[tx.ID]; len(names) > 0 {
+			result[tx.ID] = slices.Clone(names)
+		}
+	}
+	return result, nil
+}
+
+func (s *ReceiptStore) loadLinksLocked() error {
+	if s.byTx != nil {
+		return nil
+	}
+	byTx := make(map[string][]string)
+	f, err := os.Open(filepath.Join(s.dir, "links.jsonl"))
+	if errors.Is(err, fs.ErrNotExist) {
+		s.byTx = byTx
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var link receiptLink
+		if json.Unmarshal(scanner.Bytes(), &link) != nil {
+			continue // a line cut short by a crash
+		}
+		byTx[link.TransactionID] = link.Receipts
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.byTx = byTx
+	return nil
+}
+
+// thumbnail scales the image down to fit into size×size pixels, averaging
+// the source pixels covered by each thumbnail pixel.
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	scale := (max(b.Dx(), b.Dy()) + size - 1) / size
+	if scale <= 1 {
+		return src
+	}
+	w, h := (b.Dx()+scale-1)/scale, (b.Dy()+scale-1)/scale
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			var r, g, bl, n uint64
+			for sy := b.Min.Y + y*scale; sy < min(b.Min.Y+(y+1)*scale, b.Max.Y); sy++ {
+				for sx := b.Min.X + x*scale; sx < min(b.Min.X+(x+1)*scale, b.Max.X); sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), 0xffff})
+		}
+	}
+	return dst
+}
+
+// saveReceipts stores the uploaded receipt photos and adds their names to the
+// receipt_name form values, which also carry the receipts uploaded with an
+// earlier submission of the form. Unknown names are dropped. Files that
+// aren't photos are reported as a validation error after saving the rest.
+func (app *App) saveReceipts(r *http.Request) error {
+	if app.Receipts == nil {
+		delete(r.Form, "receipt_name")
+		return nil
+	}
+	names := slices.DeleteFunc(slices.Clone(r.Form["receipt_name"]), func(name string) bool {
+		return !app.Receipts.Exists(name)
+	})
+	var verr *ValidationError
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["receipt"] {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			name, err := app.Receipts.Save(f)
+			f.Close()
+			if errors.Is(err, errNotAnImage) {
+				if verr == nil {
+					verr = &ValidationError{}
+				}
+				verr.Add("receipt", fmt.Sprintf("%s is %v.", fh.Filename, err))
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	r.Form["receipt_name"] = names
+	if verr != nil {
+		return verr
+	}
+	return nil
+}
+
+// linkReceipts records the receipts of a transaction sent to YNAB. The memo
+// links to them anyway, so failing to record them isn't worth failing the
+// request over.
+func (app *App) linkReceipts(txID string, names []string) {
+	if app.Receipts == nil || txID == "" {
+		return
+	}
+	if err := app.Receipts.Link(txID, names); err != nil {
+		log.Printf("WARNING: receipts: %v", err)
+	}
+}
+
+// receiptsOf returns the receipt names of each of the transactions
+func (app *App) receiptsOf(txs ...*YNABTransaction) map[string][]string {
+	if app.Receipts == nil {
+		return nil
+	}
+	result, err := app.Receipts.ForTransactions(txs)
+	if err != nil {
+		log.Printf("WARNING: receipts: %v", err)
+	}
+	return result
+}
+
+// receiptURL returns the absolute URL of a receipt for memos, which are read
+// outside of this site.
+func (app *App) receiptURL(r *http.Request, name string) string {
+	base := strings.TrimSuffix(app.Config.PublicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if isHTTPS(r) {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + app.BasePath + "/receipts/" + name
+}
+
+// withReceiptLinks appends links to the receipts to the memo
+func (app *App) withReceiptLinks(r *http.Request, comment string, names []string) string {
+	for _, name := range names {
+		comment = strings.TrimSpace(comment + " " + app.receiptURL(r, name))
+	}
+	return comment
+}
+
+// withoutReceiptLinks removes the links added by withReceiptLinks
+func withoutReceiptLinks(comment string) string {
+	return strings.TrimSpace(receiptLinkRe.ReplaceAllString(comment, ""))
+}
+
+// handleReceipt serves a receipt image or, with ?thumb=1, its thumbnail.
+// Receipt names can't be guessed, so they are served without a login
+// to keep the links in YNAB memos working.
+func (app *App) handleReceipt(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("name")
+	if app.Receipts == nil || !app.Receipts.Exists(name) {
+		http.NotFound(w, r)
+		return nil
+	}
+	path := app.Receipts.path(name)
+	if r.FormValue("thumb") != "" {
+		if _, err := os.Stat(app.Receipts.thumbnailPath(name)); err == nil {
+			path = app.Receipts.thumbnailPath(name)
+		}
+	}
+	// Content never changes under the same name
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, path)
+	return nil
+}
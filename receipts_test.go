@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func postMultipart(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) error, path, id string, form url.Values, files map[string][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, values := range form {
+		for _, v := range values {
+			mw.WriteField(k, v)
+		}
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("receipt", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	if err := handler(w, req); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReceipts(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.Receipts = openReceiptStore(t.TempDir())
+	app.Config.PublicURL = "https://expenses.example.com/"
+
+	form := url.Values{
+		"date":     {"2025-02-01"},
+		"amount":   {"25"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C2"},
+		"comment":  {"Cat litter"},
+	}
+	w := postMultipart(t, app.handleEnterExpense, "/enter", "", form, map[string][]byte{
+		"notes.txt": []byte("not a photo"),
+		"shop.png":  testPNG(t, 600, 300),
+	})
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "notes.txt is not a JPEG") {
+		t.Fatalf("Expected the text file rejected, got %d", w.Code)
+	}
+	// The photo is kept in the form shown again
+	i := strings.Index(w.Body.String(), `name="receipt_name" value="`)
+	if i < 0 {
+		t.Fatalf("Expected the uploaded photo in the form")
+	}
+	name := w.Body.String()[i+len(`name="receipt_name" value="`):][:28]
+	if !receiptNameRe.MatchString(name) {
+		t.Fatalf("receipt name = %q", name)
+	}
+
+	form["receipt_name"] = []string{name}
+	w = postMultipart(t, app.handleEnterExpense, "/enter", "", form, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+
+	app.cache().expire()
+	body := getPage(t, app.handleIndex, "/", "")
+	link := "https://expenses.example.com/receipts/" + name
+	data, _ := app.loadData(context.Background(), "")
+	i = slices.IndexFunc(data.Transactions, func(tx *YNABTransaction) bool { return strings.Contains(tx.Comment, "Cat litter") })
+	if i < 0 {
+		t.Fatalf("Expected the transaction in YNAB")
+	}
+	tx := data.Transactions[i]
+	if tx.Comment != "₾25 @2.5 Cat litter "+link {
+		t.Errorf("memo = %q", tx.Comment)
+	}
+	if !strings.Contains(body, `/receipts/`+name+`?thumb=1`) || strings.Contains(body, link) {
+		t.Errorf("Expected a thumbnail instead of the link in the history")
+	}
+
+	body = getPage(t, app.handleEditExpense, "/transactions/"+tx.ID+"/edit", tx.ID)
+	if !strings.Contains(body, `value="Cat litter"`) || !strings.Contains(body, `value="`+name+`" checked`) {
+		t.Errorf("Expected the edit form to list the receipt apart from the comment")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+name+"?thumb=1", nil)
+	req.SetPathValue("name", name)
+	rec := httptest.NewRecorder()
+	if err := app.handleReceipt(rec, req); err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := jpeg.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("thumbnail: %v", err)
+	}
+	if b := thumb.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Errorf("thumbnail is %dx%d, wanted 200x100", b.Dx(), b.Dy())
+	}
+
+	// Unchecking the receipt drops it from the memo and the history
+	delete(form, "receipt_name")
+	w = postMultipart(t, app.handleUpdateExpense, "/transactions/"+tx.ID, tx.ID, form, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+	body = getPage(t, app.handleIndex, "/", "")
+	if strings.Contains(body, name) {
+		t.Errorf("Expected the receipt removed")
+	}
+
+	// Links survive restarts
+	delete(receiptStores, app.Receipts.dir)
+	store := openReceiptStore(app.Receipts.dir)
+	if err := store.Link("T1", []string{name}); err != nil {
+		t.Fatal(err)
+	}
+	delete(receiptStores, app.Receipts.dir)
+	links, err := openReceiptStore(app.Receipts.dir).ForTransactions([]*YNABTransaction{tx, {ID: "T1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || len(links["T1"]) != 1 || links["T1"][0] != name {
+		t.Errorf("links = %v", links)
+	}
+}
+
+func TestReceipt_notFound(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.Receipts = openReceiptStore(t.TempDir())
+	for _, name := range []string{"../config.json", "0123456789abcdef01234567.png"} {
+		req := httptest.NewRequest(http.MethodGet, "/receipts/x", nil)
+		req.SetPathValue("name", name)
+		w := httptest.NewRecorder()
+		if err := app.handleReceipt(w, req); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestReceiptStore_hugeImage(t *testing.T) {
+	// A small PNG claiming to be 50000x50000 pixels
+	raw := testPNG(t, 2, 2)
+	binary.BigEndian.PutUint32(raw[16:], 50_000)
+	binary.BigEndian.PutUint32(raw[20:], 50_000)
+	binary.BigEndian.PutUint32(raw[29:], crc32.ChecksumIEEE(raw[12:29]))
+
+	s := openReceiptStore(t.TempDir())
+	name, err := s.Save(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.path(name)); err != nil {
+		t.Errorf("Expected the original saved: %v", err)
+	}
+	if _, err := os.Stat(s.thumbnailPath(name)); !os.IsNotExist(err) {
+		t.Errorf("Expected no thumbnail, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+// Offline entry: expenses submitted without a connection go into
+// ExpenseQueue (queue.js) and are shown above the history until they are
+// sent, which happens when the connection returns. Also fills in the form
+// when a known payee is chosen.
+(function () {
+  const Q = window.ExpenseQueue;
+  const SYNC_TAG = "expense-queue";
+  const RETRY_INTERVAL = 30 * 1000;
+
+  function registerServiceWorker() {
+    if (!("serviceWorker" in navigator)) return;
+    const base = document.body.dataset.basePath || "";
+    navigator.serviceWorker.register(base + "/sw.js", { scope: base + "/" }).catch((err) => {
+      console.warn("Service worker not registered:", err);
+    });
+  }
+
+  function requestBackgroundSync() {
+    if (!("serviceWorker" in navigator)) return;
+    navigator.serviceWorker.ready
+      .then((reg) => reg.sync && reg.sync.register(SYNC_TAG))
+      .catch(() => {}); // replayed from the page instead
+  }
+
+  // selectedText returns the name of the chosen option, without the balance
+  // shown next to categories
+  function selectedText(form, name) {
+    const select = form.elements[name];
+    if (!select || select.selectedIndex < 0) return "";
+    const option = select.options[select.selectedIndex];
+    return option.dataset.name || option.text;
+  }
+
+  // queue stores the form's expense to be sent later. A submission that may
+  // have reached the server keeps its token, so that sending it again can't
+  // enter it twice; others get a new one.
+  async function queue(form, keepToken) {
+    const data = new FormData(form);
+    await Q.add(
+      form.dataset.offlineQueue,
+      data,
+      {
+        date: data.get("date"),
+        amount: data.get("amount"),
+        currency: data.get("currency"),
+        account: selectedText(form, "account"),
+        category: selectedText(form, "category"),
+        payee: data.get("payee"),
+        comment: data.get("comment"),
+      },
+      keepToken ? data.get("token") : "",
+    );
+    form.reset();
+    form.elements["token"].value = Q.newToken();
+    await render();
+    requestBackgroundSync();
+  }
+
+  // Submitting without a connection queues the expense instead
+  document.addEventListener(
+    "submit",
+    (e) => {
+      const form = e.target;
+      if (!form.matches("form[data-offline-queue]") || navigator.onLine) return;
+      if (e.submitter && e.submitter.name === "add_split") return;
+      e.preventDefault();
+      e.stopImmediatePropagation();
+      queue(form, false);
+    },
+    true,
+  );
+
+  // ...and so does a submission that failed to reach the server
+  document.addEventListener("turbo:submit-end", (e) => {
+    const { fetchResponse, formSubmission } = e.detail;
+    const form = formSubmission.formElement;
+    if (fetchResponse || !form.matches("form[data-offline-queue]")) return;
+    if (formSubmission.submitter && formSubmission.submitter.name === "add_split") return;
+    queue(form, true);
+  });
+
+  // Choosing a known payee fills in the account, category and currency of
+  // the latest expense paid to it
+  document.addEventListener("input", (e) => {
+    const input = e.target;
+    if (!input.matches("input[name=payee]") || !input.list) return;
+    const option = Array.from(input.list.options).find((o) => o.value === input.value);
+    if (!option) return;
+    for (const name of ["account", "category", "currency"]) {
+      const select = input.form.elements[name];
+      const value = option.dataset[name];
+      if (select && value && Array.from(select.options).some((o) => o.value === value)) {
+        select.value = value;
+      }
+    }
+  });
+
+  function el(tag, className, text) {
+    const e = document.createElement(tag);
+    if (className) e.className = className;
+    if (text) e.textContent = text;
+    return e;
+  }
+
+  function button(text, className, onClick) {
+    const b = el("button", "font-medium " + className, text);
+    b.type = "button";
+    b.addEventListener("click", onClick);
+    return b;
+  }
+
+  function card(entry) {
+    const s = entry.summary;
+    const div = el("div", "bg-white shadow-sm ring-1 ring-gray-900/5 rounded-lg p-3 flex flex-col gap-2 border-l-4 border-amber-400");
+
+    const head = el("div", "flex items-baseline gap-x-3");
+    head.append(el("div", "font-medium", s.category), el("div", "text-sm text-gray-500", s.date));
+    head.append(el("div", "ml-auto font-medium", `${s.amount} ${s.currency}`));
+    div.append(head);
+
+    const details = el("div", "flex flex-wrap gap-x-3 gap-y-1 text-sm");
+    details.append(el("div", "text-gray-500", s.account));
+    if (s.payee) details.append(el("div", "font-medium text-gray-700", s.payee));
+    if (s.comment) details.append(el("div", "text-gray-700", s.comment));
+    div.append(details);
+
+    div.append(el("div", "text-sm text-amber-700", entry.message || "Waiting for a connection."));
+
+    const actions = el("div", "flex gap-3 text-sm");
+    if (entry.status === "duplicate") {
+      actions.append(
+        button("Enter anyway", "text-blue-600 hover:text-blue-500", async () => {
+          entry.status = "pending";
+          entry.allowDuplicate = true;
+          await Q.put(entry);
+          await render();
+          replay();
+        }),
+      );
+    }
+    actions.append(
+      button("Discard", "text-red-600 hover:text-red-500", async () => {
+        if (!confirm("Discard this expense?")) return;
+        await Q.remove(entry.token);
+        await render();
+      }),
+    );
+    div.append(actions);
+    return div;
+  }
+
+  async function render() {
+    const box = document.getElementById("queued-entries");
+    if (!box) return;
+    const base = box.dataset.basePath;
+    const entries = (await Q.list()).filter((e) => e.basePath === base).reverse();
+    box.replaceChildren(...entries.map(card));
+    box.hidden = entries.length === 0;
+  }
+
+  async function replay() {
+    const result = await Q.replay();
+    await render();
+    // Show the entered expenses in the history
+    if (result.sent > 0 && document.getElementById("queued-entries") && window.Turbo) {
+      Turbo.visit(location.href, { action: "replace" });
+    }
+  }
+
+  function load() {
+    registerServiceWorker();
+    render().then(replay);
+  }
+
+  if (window.Turbo) {
+    document.addEventListener("turbo:load", load);
+  } else {
+    // Without Turbo, pages load normally and forms ask to confirm themselves
+    document.addEventListener("DOMContentLoaded", load);
+    document.addEventListener("submit", (e) => {
+      const message = e.target.dataset.turboConfirm;
+      if (message && !confirm(message)) e.preventDefault();
+    });
+  }
+  window.addEventListener("online", replay);
+  setInterval(() => navigator.onLine && replay(), RETRY_INTERVAL);
+
+  if ("serviceWorker" in navigator) {
+    navigator.serviceWorker.addEventListener("message", (e) => {
+      if (e.data === "queue-changed") render();
+    });
+  }
+})();
@@ -0,0 +1,142 @@
+// ExpenseQueue keeps the expenses entered without a connection in IndexedDB,
+// where both the page (app.js) and the service worker (sw.js) can send them
+// to /sync later. Every entry has its own token, sent to YNAB as import_id,
+// so sending an entry twice can't enter it twice.
+(function (global) {
+  const DB_NAME = "ynabexpenseform";
+  const STORE = "queue";
+
+  function openDB() {
+    return new Promise((resolve, reject) => {
+      const req = indexedDB.open(DB_NAME, 1);
+      req.onupgradeneeded = () => req.result.createObjectStore(STORE, { keyPath: "token" });
+      req.onsuccess = () => resolve(req.result);
+      req.onerror = () => reject(req.error);
+    });
+  }
+
+  async function withStore(mode, fn) {
+    const db = await openDB();
+    return new Promise((resolve, reject) => {
+      const tx = db.transaction(STORE, mode);
+      const req = fn(tx.objectStore(STORE));
+      tx.oncomplete = () => {
+        db.close();
+        resolve(req.result);
+      };
+      tx.onerror = () => {
+        db.close();
+        reject(tx.error);
+      };
+    });
+  }
+
+  function newToken() {
+    const b = new Uint8Array(16);
+    crypto.getRandomValues(b);
+    return Array.from(b, (x) => x.toString(16).padStart(2, "0")).join("");
+  }
+
+  // add queues the fields of a submitted form (a FormData) for the form at
+  // basePath. The summary is what the history shows until it's sent.
+  async function add(basePath, formData, summary, token) {
+    const fields = [];
+    for (const [name, value] of formData) {
+      if (name === "token" || name === "allow_duplicate") continue;
+      if (value instanceof Blob && value.size === 0) continue; // no photo chosen
+      fields.push([name, value]);
+    }
+    const entry = {
+      token: token || newToken(),
+      basePath,
+      fields,
+      summary,
+      queuedAt: Date.now(),
+      status: "pending", // or "duplicate" or "invalid", as reported by /sync
+      message: "",
+      allowDuplicate: false,
+    };
+    await withStore("readwrite", (s) => s.put(entry));
+    return entry;
+  }
+
+  // list returns the queued entries, oldest first
+  async function list() {
+    const entries = await withStore("readonly", (s) => s.getAll());
+    return entries.sort((a, b) => a.queuedAt - b.queuedAt);
+  }
+
+  function put(entry) {
+    return withStore("readwrite", (s) => s.put(entry));
+  }
+
+  function remove(token) {
+    return withStore("readwrite", (s) => s.delete(token));
+  }
+
+  // send posts the entry to /sync, returning false if it should be tried
+  // again later
+  async function send(entry) {
+    const body = new FormData();
+    for (const [name, value] of entry.fields) body.append(name, value);
+    body.append("token", entry.token);
+    if (entry.allowDuplicate) body.append("allow_duplicate", "1");
+
+    let res;
+    try {
+      res = await fetch(entry.basePath + "/sync", {
+        method: "POST",
+        body,
+        credentials: "same-origin",
+        redirect: "manual",
+        headers: { Accept: "application/json" },
+      });
+    } catch (err) {
+      return false; // still offline
+    }
+    const isJSON = (res.headers.get("Content-Type") || "").startsWith("application/json");
+    if (res.ok && isJSON) {
+      await remove(entry.token);
+      return true;
+    }
+    if ((res.status === 409 || res.status === 422) && isJSON) {
+      const result = await res.json();
+      entry.status = result.status;
+      entry.message = result.message;
+      await put(entry);
+      return true;
+    }
+    if (res.type === "opaqueredirect") {
+      entry.message = "Log in to send this expense.";
+    } else {
+      entry.message = `Sending failed (HTTP ${res.status}), will try again.`;
+    }
+    await put(entry);
+    return false;
+  }
+
+  let replaying = null;
+
+  // replay sends the pending entries one by one, resolving to the number of
+  // entries sent and whether some are left to try again later
+  function replay() {
+    if (!replaying) {
+      replaying = (async () => {
+        let sent = 0;
+        try {
+          for (const entry of await list()) {
+            if (entry.status !== "pending") continue;
+            if (!(await send(entry))) return { sent, pending: true };
+            sent++;
+          }
+          return { sent, pending: false };
+        } finally {
+          replaying = null;
+        }
+      })();
+    }
+    return replaying;
+  }
+
+  global.ExpenseQueue = { add, list, put, remove, replay, newToken };
+})(self);
@@ -0,0 +1,71 @@
+// The service worker keeps the last version of each page and the styles and
+// scripts it uses, so that the form opens without a connection, and sends
+// the queued expenses in the background where the browser supports it.
+importScripts("/static/queue.js");
+
+const CACHE = "ynabexpenseform-v2";
+const SYNC_TAG = "expense-queue";
+
+self.addEventListener("install", () => self.skipWaiting());
+
+self.addEventListener("activate", (e) => {
+  e.waitUntil(
+    caches
+      .keys()
+      .then((keys) => Promise.all(keys.filter((k) => k !== CACHE).map((k) => caches.delete(k))))
+      .then(() => self.clients.claim()),
+  );
+});
+
+function store(key, res) {
+  if (res.ok) {
+    const copy = res.clone();
+    caches.open(CACHE).then((cache) => cache.put(key, copy));
+  }
+  return res;
+}
+
+function offline() {
+  return new Response("You are offline and this page hasn't been opened before.", {
+    status: 503,
+    headers: { "Content-Type": "text/plain; charset=utf-8" },
+  });
+}
+
+self.addEventListener("fetch", (e) => {
+  const req = e.request;
+  if (req.method !== "GET") return;
+  const url = new URL(req.url);
+
+  if (req.mode === "navigate") {
+    // Pages come from the network whenever possible, so that a cached copy
+    // with stale balances only shows up offline
+    const key = url.origin + url.pathname;
+    e.respondWith(
+      fetch(req)
+        .then((res) => (res.redirected ? res : store(key, res)))
+        .catch(() => caches.match(key).then((res) => res || offline())),
+    );
+    return;
+  }
+
+  if (url.origin === location.origin && url.pathname.startsWith("/static/")) {
+    // Assets have the hash of their content in their names, so a cached
+    // copy never goes stale
+    e.respondWith(caches.match(req).then((hit) => hit || fetch(req).then((res) => store(req, res))));
+  }
+});
+
+self.addEventListener("sync", (e) => {
+  if (e.tag !== SYNC_TAG) return;
+  e.waitUntil(
+    ExpenseQueue.replay().then(async (result) => {
+      for (const client of await self.clients.matchAll()) {
+        client.postMessage("queue-changed");
+      }
+      if (result.pending) {
+        throw new Error("Some expenses are left to send"); // makes the browser retry
+      }
+    }),
+  );
+});
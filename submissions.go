@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// How long a submission token is remembered after use
+const submissionTTL = 24 * time.Hour
+
+// submissionLog remembers recently used form tokens, so that a double-tap or
+// a retried POST doesn't create a second YNAB transaction.
+type submissionLog struct {
+	mut     sync.Mutex
+	entries map[string]*submission
+}
+
+type submission struct {
+	done chan struct{}
+	txID string
+	at   time.Time
+}
+
+var recentSubmissions = &submissionLog{
+	entries: make(map[string]*submission),
+}
+
+func newSubmissionToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// begin reserves the token for a new submission and returns fresh=true.
+// If the token has already been used, it waits for that submission to finish
+// and returns the ID of the transaction it created.
+func (l *submissionLog) begin(ctx context.Context, token string) (txID string, fresh bool, err error) {
+	for {
+		l.mut.Lock()
+		l.pruneLocked(time.Now())
+		s := l.entries[token]
+		if s == nil {
+			l.entries[token] = &submission{
+				done: make(chan struct{}),
+				at:   time.Now(),
+			}
+			l.mut.Unlock()
+			return "", true, nil
+		}
+		l.mut.Unlock()
+
+		select {
+		case <-s.done:
+			l.mut.Lock()
+			aborted := l.entries[token] != s
+			l.mut.Unlock()
+			if !aborted {
+				return s.txID, false, nil
+			}
+			// The original submission failed, so this one gets to try again
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+	}
+}
+
+// finish records the transaction created for the token
+func (l *submissionLog) finish(token, txID string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if s := l.entries[token]; s != nil {
+		s.txID = txID
+		s.at = time.Now()
+		close(s.done)
+	}
+}
+
+// abort forgets the token after a failed submission, so that it can be retried
+func (l *submissionLog) abort(token string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if s := l.entries[token]; s != nil {
+		delete(l.entries, token)
+		close(s.done)
+	}
+}
+
+func (l *submissionLog) pruneLocked(now time.Time) {
+	for token, s := range l.entries {
+		select {
+		case <-s.done:
+			if now.Sub(s.at) > submissionTTL {
+				delete(l.entries, token)
+			}
+		default:
+		}
+	}
+}
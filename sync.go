@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// ServerKnowledge tracks the YNAB server_knowledge value returned by each
+// delta-capable endpoint.
+type ServerKnowledge struct {
+	Accounts     int64 `json:"accounts"`
+	Payees       int64 `json:"payees"`
+	Categories   int64 `json:"categories"`
+	Transactions int64 `json:"transactions"`
+}
+
+// YNABSyncState holds the raw YNAB entities needed to apply delta responses.
+// Entities are never mutated once decoded; merging replaces them instead.
+type YNABSyncState struct {
+	Knowledge    ServerKnowledge   `json:"knowledge"`
+	Accounts     []*apiAccount     `json:"accounts"`
+	Payees       []*apiPayee       `json:"payees"`
+	Categories   []*apiCategory    `json:"categories"`
+	Transactions []*apiTransaction `json:"transactions"`
+}
+
+func (s *YNABSyncState) Clone() *YNABSyncState {
+	return &YNABSyncState{
+		Knowledge:    s.Knowledge,
+		Accounts:     slices.Clone(s.Accounts),
+		Payees:       slices.Clone(s.Payees),
+		Categories:   slices.Clone(s.Categories),
+		Transactions: slices.Clone(s.Transactions),
+	}
+}
+
+type apiAccount struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Balance         Amount `json:"balance"`
+	TransferPayeeID string `json:"transfer_payee_id"`
+	Closed          bool   `json:"closed"`
+	Deleted         bool   `json:"deleted"`
+}
+
+type apiPayee struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	TransferAccountID string `json:"transfer_account_id"`
+	Deleted           bool   `json:"deleted"`
+}
+
+type apiCategory struct {
+	ID              string `json:"id"`
+	CategoryGroupID string `json:"category_group_id"`
+	Name            string `json:"name"`
+	Hidden          bool   `json:"hidden"`
+	Deleted         bool   `json:"deleted"`
+
+	// The current month's figures
+	Budgeted Amount `json:"budgeted"`
+	Activity Amount `json:"activity"`
+	Balance  Amount `json:"balance"`
+
+	GoalType               string `json:"goal_type"` // empty if there's no goal
+	GoalTarget             Amount `json:"goal_target"`
+	GoalTargetMonth        string `json:"goal_target_month"`
+	GoalPercentageComplete int    `json:"goal_percentage_complete"`
+	GoalUnderFunded        Amount `json:"goal_under_funded"`
+}
+
+type apiTransaction struct {
+	ID                    string `json:"id"`
+	AccountID             string `json:"account_id"`
+	CategoryID            string `json:"category_id"`
+	Date                  string `json:"date"`
+	Memo                  string `json:"memo"`
+	Amount                Amount `json:"amount"` // milliunits in YNAB
+	TransferAccountID     string `json:"transfer_account_id"`
+	PayeeID               string `json:"payee_id"`
+	PayeeName             string `json:"payee_name"`
+	TransferTransactionID string `json:"transfer_transaction_id"`
+	ImportID              string `json:"import_id"`
+	Deleted               bool   `json:"deleted"`
+
+	Subtransactions []*apiSubtransaction `json:"subtransactions,omitempty"`
+}
+
+type apiSubtransaction struct {
+	ID         string `json:"id"`
+	CategoryID string `json:"category_id"`
+	Memo       string `json:"memo"`
+	Amount     Amount `json:"amount"`
+	Deleted    bool   `json:"deleted"`
+}
+
+type syncEntity interface {
+	entityID() string
+	isDeleted() bool
+}
+
+func (a *apiAccount) entityID() string     { return a.ID }
+func (a *apiAccount) isDeleted() bool      { return a.Deleted }
+func (p *apiPayee) entityID() string       { return p.ID }
+func (p *apiPayee) isDeleted() bool        { return p.Deleted }
+func (c *apiCategory) entityID() string    { return c.ID }
+func (c *apiCategory) isDeleted() bool     { return c.Deleted }
+func (t *apiTransaction) entityID() string { return t.ID }
+func (t *apiTransaction) isDeleted() bool  { return t.Deleted }
+
+// mergeDelta applies added, changed and deleted entities to items, keeping
+// the original order and appending new entities at the end.
+func mergeDelta[T syncEntity](items, delta []T) []T {
+	if len(delta) == 0 {
+		return items
+	}
+	result := slices.Clone(items)
+	index := make(map[string]int, len(result))
+	for i, it := range result {
+		index[it.entityID()] = i
+	}
+	for _, d := range delta {
+		if i, ok := index[d.entityID()]; ok {
+			result[i] = d
+		} else {
+			index[d.entityID()] = len(result)
+			result = append(result, d)
+		}
+	}
+	return slices.DeleteFunc(result, func(it T) bool {
+		return it.isDeleted()
+	})
+}
+
+// internalPayees are the payees YNAB uses for its own adjustments
+var internalPayees = []string{"Starting Balance", "Manual Balance Adjustment", "Reconciliation Balance Adjustment"}
+
+// buildYNABData produces the view of the budget the app works with (only the
+// configured accounts and categories) out of the raw sync state.
+func buildYNABData(cfg *AppConfig, budgetID string, state *YNABSyncState) (*YNABData, error) {
+	// Map of account ID to transfer payee ID
+	accountToPayeeID := make(map[string]string)
+	for _, p := range state.Payees {
+		if p.TransferAccountID != "" {
+			accountToPayeeID[p.TransferAccountID] = p.ID
+		}
+	}
+
+	accountsByName := make(map[string]*apiAccount)
+	for _, a := range state.Accounts {
+		accountsByName[a.Name] = a
+	}
+
+	var accounts []*YNABAccount
+	for _, name := range cfg.Accounts {
+		a, ok := accountsByName[name]
+		if !ok {
+			return nil, fmt.Errorf("account named %q not found", name)
+		}
+		account := &YNABAccount{
+			ID:              a.ID,
+			Name:            a.Name,
+			Balance:         a.Balance,
+			TransferPayeeID: a.TransferPayeeID,
+		}
+		if payeeID, ok := accountToPayeeID[a.ID]; ok {
+			account.TransferPayeeID = payeeID
+		}
+		accounts = append(accounts, account)
+	}
+
+	categoriesByName := make(map[string]*apiCategory)
+	for _, c := range state.Categories {
+		categoriesByName[c.Name] = c
+	}
+
+	var categories []*YNABCategory
+	for _, name := range cfg.Categories {
+		c, ok := categoriesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("category named %q not found", name)
+		}
+		categories = append(categories, &YNABCategory{
+			ID:                     c.ID,
+			Name:                   c.Name,
+			Budgeted:               c.Budgeted,
+			Activity:               c.Activity,
+			Balance:                c.Balance,
+			GoalType:               c.GoalType,
+			GoalTarget:             c.GoalTarget,
+			GoalTargetMonth:        c.GoalTargetMonth,
+			GoalPercentageComplete: c.GoalPercentageComplete,
+			GoalUnderFunded:        c.GoalUnderFunded,
+		})
+	}
+
+	var payees []*YNABPayee
+	for _, p := range state.Payees {
+		if p.TransferAccountID == "" && !slices.Contains(internalPayees, p.Name) {
+			payees = append(payees, &YNABPayee{ID: p.ID, Name: p.Name})
+		}
+	}
+
+	// Generate transfer pseudo-categories
+	transferCategories := GenerateTransferCategories(accounts)
+
+	// Combine real categories and transfer categories
+	allCategories := make([]*YNABCategory, 0, len(categories)+len(transferCategories))
+	allCategories = append(allCategories, categories...)
+	allCategories = append(allCategories, transferCategories...)
+
+	return &YNABData{
+		BudgetID:      budgetID,
+		Accounts:      accounts,
+		Categories:    categories,
+		Transactions:  buildTransactions(state.Transactions, accounts, categories),
+		AllCategories: allCategories,
+		Payees:        payees,
+		Sync:          state,
+	}, nil
+}
+
+func buildTransactions(raw []*apiTransaction, accounts []*YNABAccount, categories []*YNABCategory) []*YNABTransaction {
+	accountsByID := make(map[string]*YNABAccount)
+	for _, a := range accounts {
+		accountsByID[a.ID] = a
+	}
+
+	categoriesByID := make(map[string]*YNABCategory)
+	for _, c := range categories {
+		categoriesByID[c.ID] = c
+	}
+
+	result := make([]*YNABTransaction, 0, len(raw))
+
+	// We'll filter transfers to only show negative amounts (outflows)
+
+	for _, t := range raw {
+		account := accountsByID[t.AccountID]
+		if account == nil {
+			continue
+		}
+
+		// Check if this is a transfer by looking at transfer_account_id
+		isTransfer := t.TransferAccountID != ""
+		var transferAccount *YNABAccount
+		var category *YNABCategory
+		var subtransactions []*YNABSubtransaction
+
+		if isTransfer {
+			// For transfers, find the target account
+			transferAccount = accountsByID[t.TransferAccountID]
+
+			// Only include transfers between accounts we're tracking
+			if transferAccount == nil {
+				continue
+			}
+
+			// For transfers, only show the outflow (negative amount)
+			// This eliminates duplicate display of transfers
+			if t.Amount > 0 {
+				continue
+			}
+
+			// Create a pseudo-category for the transfer
+			category = &YNABCategory{
+				ID:           "transfer-to-" + t.TransferAccountID,
+				Name:         "Transfer to " + transferAccount.Name,
+				IsTransfer:   true,
+				TransferToID: t.TransferAccountID,
+			}
+		} else if subtransactions = buildSubtransactions(t.Subtransactions, categoriesByID); subtransactions != nil {
+			category = SplitCategory
+		} else if len(t.Subtransactions) > 0 {
+			// A split with none of the configured categories
+			continue
+		} else {
+			// For regular transactions, get the category
+			category = categoriesByID[t.CategoryID]
+			if category == nil {
+				log.Printf("category %q not found", t.CategoryID)
+				continue
+			}
+		}
+
+		tx := &YNABTransaction{
+			ID:              t.ID,
+			Date:            t.Date,
+			Category:        category,
+			Account:         account,
+			TransferAccount: transferAccount,
+			Comment:         t.Memo,
+			Amount:          t.Amount,
+			AmountUSD:       t.Amount,
+			IsTransfer:      isTransfer,
+			ImportID:        t.ImportID,
+			Subtransactions: subtransactions,
+		}
+		if !isTransfer {
+			tx.PayeeID, tx.PayeeName = t.PayeeID, t.PayeeName
+		}
+		result = append(result, tx)
+	}
+
+	// Delta responses append new transactions at the end; keep date order
+	// consistent with a full load.
+	slices.SortStableFunc(result, func(a, b *YNABTransaction) int {
+		return strings.Compare(a.Date, b.Date)
+	})
+	return result
+}
+
+// buildSubtransactions returns the parts of a split transaction, or nil if
+// none of them belongs to a configured category.
+func buildSubtransactions(raw []*apiSubtransaction, categoriesByID map[string]*YNABCategory) []*YNABSubtransaction {
+	var result []*YNABSubtransaction
+	relevant := false
+	for _, st := range raw {
+		if st.Deleted {
+			continue
+		}
+		category := categoriesByID[st.CategoryID]
+		if category != nil {
+			relevant = true
+		}
+		result = append(result, &YNABSubtransaction{
+			Category: category,
+			Comment:  st.Memo,
+			Amount:   st.Amount,
+		})
+	}
+	if !relevant {
+		return nil
+	}
+	return result
+}
+
+// changedTransactions lists the IDs of transactions added or updated between
+// two sync states, and of those removed. Entities are replaced rather than
+// mutated on merge, so a changed transaction is a different pointer.
+func changedTransactions(prev, next *YNABSyncState) (changed, removed []string) {
+	seen := make(map[*apiTransaction]bool, len(prev.Transactions))
+	for _, t := range prev.Transactions {
+		seen[t] = true
+	}
+	kept := make(map[string]bool, len(next.Transactions))
+	for _, t := range next.Transactions {
+		kept[t.ID] = true
+		if !seen[t] {
+			changed = append(changed, t.ID)
+		}
+	}
+	for _, t := range prev.Transactions {
+		if !kept[t.ID] {
+			removed = append(removed, t.ID)
+		}
+	}
+	return changed, removed
+}
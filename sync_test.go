@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newFakeYNABConfig(fake *FakeYNAB) *AppConfig {
+	return &AppConfig{
+		YNABToken:   "test-token",
+		YNABBaseURL: fake.BaseURL(),
+		BudgetName:  "Family Budget",
+		Categories:  []string{"Groceries", "Dining Out"},
+		Accounts:    []string{"Cash", "Held By Assistant"},
+	}
+}
+
+func TestLoadYNABData_delta(t *testing.T) {
+	fake := NewFakeYNAB("Family Budget")
+	defer fake.Close()
+	fake.AddAccount("A1", "Cash", 100_000)
+	fake.AddAccount("A2", "Held By Assistant", 0)
+	fake.AddAccount("A3", "Checking", 0)
+	fake.AddCategory("C1", "Groceries")
+	fake.AddCategory("C2", "Dining Out")
+	fake.PutTransaction(apiTransaction{ID: "T1", AccountID: "A1", CategoryID: "C1", Date: "2025-01-10", Memo: "Milk", Amount: -3_450})
+	fake.PutTransaction(apiTransaction{ID: "T2", AccountID: "A1", CategoryID: "C2", Date: "2025-01-11", Memo: "Lunch", Amount: -12_990})
+	fake.PutTransaction(apiTransaction{ID: "T3", AccountID: "A3", CategoryID: "C1", Date: "2025-01-12", Memo: "Other account", Amount: -1_000})
+	cfg := newFakeYNABConfig(fake)
+	ctx := context.Background()
+
+	data, err := LoadYNABData(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs := fake.Requests(); len(reqs) != 5 || strings.Contains(strings.Join(reqs, "\n"), "last_knowledge_of_server") {
+		t.Fatalf("full load requests = %q", reqs)
+	}
+	assertTransactionMemos(t, data, "Milk", "Lunch")
+	if a := data.AccountByID("A1"); a.Balance != 100_000-3_450-12_990 {
+		t.Errorf("Cash balance = %v", a.Balance)
+	}
+	if a := data.AccountByID("A2"); a.TransferPayeeID != "TP-A2" {
+		t.Errorf("Held By Assistant transfer payee = %q", a.TransferPayeeID)
+	}
+
+	fake.PutTransaction(apiTransaction{ID: "T1", AccountID: "A1", CategoryID: "C1", Date: "2025-01-10", Memo: "Milk and eggs", Amount: -5_000})
+	fake.DeleteTransaction("T2")
+	fake.PutTransaction(apiTransaction{ID: "T4", AccountID: "A1", CategoryID: "C2", Date: "2025-01-09", Memo: "Coffee", Amount: -2_000})
+
+	delta, err := LoadYNABData(ctx, cfg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 4 {
+		t.Fatalf("delta load requests = %q, wanted 4 without budget listing", reqs)
+	}
+	for _, r := range reqs {
+		if !strings.Contains(r, "last_knowledge_of_server=") {
+			t.Errorf("delta request without knowledge: %s", r)
+		}
+	}
+	assertTransactionMemos(t, delta, "Coffee", "Milk and eggs")
+	if a := delta.AccountByID("A1"); a.Balance != 100_000-5_000-2_000 {
+		t.Errorf("Cash balance after delta = %v", a.Balance)
+	}
+
+	// The previous snapshot must stay intact
+	assertTransactionMemos(t, data, "Milk", "Lunch")
+
+	// Nothing changed, nothing to merge
+	again, err := LoadYNABData(ctx, cfg, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransactionMemos(t, again, "Coffee", "Milk and eggs")
+}
+
+func assertTransactionMemos(t *testing.T, data *YNABData, expected ...string) {
+	t.Helper()
+	var actual []string
+	for _, tx := range data.Transactions {
+		actual = append(actual, tx.Comment)
+	}
+	if strings.Join(actual, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("transactions = %q, wanted %q", actual, expected)
+	}
+}
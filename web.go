@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"math/big"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/andreyvit/mvp/httpcall"
 )
 
 const maxVisibleTxCount = 100
@@ -22,14 +26,44 @@ var viewsFS embed.FS
 
 var tmpl = template.New("")
 
+// FormatAmount formats the amount with the currency's symbol, decimal places
+// and separators. Brief formatting, used in memos, omits zero decimals and
+// thousands separators, e.g. "₾1234" instead of "₾1,234.00".
 func FormatAmount(amount Amount, currency *Currency, brief bool) string {
-	var s string
-	if brief && amount%1000 == 0 {
-		s = fmt.Sprintf("%.0f", float64(amount)/1000.0)
-	} else {
-		s = fmt.Sprintf("%.2f", float64(amount)/1000.0)
+	unit := Amount(1)
+	for range 3 - currency.Decimals {
+		unit *= 10
+	}
+	amount = roundRat(new(big.Rat).SetInt64(int64(amount)), unit, currency.Rounding)
+
+	sign := ""
+	u := uint64(amount)
+	if amount < 0 {
+		sign = "-"
+		u = -u
+	}
+	s := strconv.FormatUint(u/1000, 10)
+	if !brief {
+		s = groupDigits(s, currency.GroupSeparator)
+	}
+	if currency.Decimals > 0 && !(brief && u%1000 == 0) {
+		s += currency.DecimalSeparator + fmt.Sprintf("%03d", u%1000)[:currency.Decimals]
 	}
-	return strings.ReplaceAll(currency.Format, "9.99", s)
+	return currency.Prefix + sign + s + currency.Suffix
+}
+
+func groupDigits(s, sep string) string {
+	if sep == "" {
+		return s
+	}
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
 
 func init() {
@@ -43,13 +77,23 @@ func init() {
 		"replace": func(s, old, new string) string {
 			return strings.Replace(s, old, new, -1)
 		},
+		"join":            strings.Join,
+		"withoutreceipts": withoutReceiptLinks,
+		"asset":           assets.URL,
+		"list": func(items ...string) []string {
+			return items
+		},
 	})
 	_, err := tmpl.ParseFS(viewsFS,
 		"views/layout.html",
 		"views/index.html",
 		"views/_form.html",
+		"views/_presets.html",
 		"views/_balances.html",
 		"views/_history.html",
+		"views/edit.html",
+		"views/login.html",
+		"views/audit.html",
 	)
 	if err != nil {
 		log.Fatalf("** template error: %v", err)
@@ -60,19 +104,50 @@ func wrap(h func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := h(w, r); err != nil {
 			log.Printf("WARNING: %s %s failed: %v", r.Method, r.URL.Path, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 		}
 	}
 }
 
-func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) error {
-	mock := r.FormValue("mock")
-
-	data, err := loadYNABDataWithCaching(r.Context(), mock, false)
-	if err != nil {
-		return err
+// errorStatus distinguishes failed YNAB calls from our own failures
+func errorStatus(err error) int {
+	if isRateLimited(err) {
+		return http.StatusServiceUnavailable
+	}
+	var callErr *httpcall.Error
+	if errors.As(err, &callErr) {
+		return http.StatusBadGateway
 	}
+	var sizeErr *http.MaxBytesError
+	if errors.As(err, &sizeErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+type pageData struct {
+	Accounts           []*YNABAccountViewModel
+	BalanceAccounts    []*YNABAccountViewModel
+	Categories         []*YNABCategoryViewModel
+	BudgetedCategories []*YNABCategoryViewModel
+	Payees             []*PayeeOption
+	Presets            []*Preset
+	Transactions       []*YNABTransaction
+	Currencies         []*Currency
+	DefaultCurrency    *Currency
+	BudgetCurrency     *Currency
+	AmountPattern      string
+	BasePath           string
+	HasAudit           bool
+	HasReceipts        bool
+	Receipts           map[string][]string // receipt names by transaction ID
+	User               *User
+	Form               *ExpenseForm
+	Mock               string
+	Notice             string // a banner above the form, like when YNAB is down or rate limits us
+}
 
+func (app *App) newPageData(data *YNABData, mock string) *pageData {
 	transactions := slices.Clone(data.Transactions)
 	slices.Reverse(transactions)
 	if len(transactions) > maxVisibleTxCount {
@@ -100,47 +175,67 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) error {
 			YNABAccount: a,
 		}
 		if app.SecondaryCurrency != nil {
-			m := app.Convert(a.Balance, app.BudgetCurrency, app.SecondaryCurrency)
-			vm.SecondaryBalance = &m
+			if m, err := app.Convert(a.Balance, app.BudgetCurrency, app.SecondaryCurrency, time.Now()); err == nil {
+				vm.SecondaryBalance = &m
+			}
 		}
 		balanceAccounts = append(balanceAccounts, vm)
 	}
 
-	// Build data for the template
-	output := struct {
-		Accounts        []*YNABAccountViewModel
-		BalanceAccounts []*YNABAccountViewModel
-		Categories      []*YNABCategory
-		Transactions    []*YNABTransaction
-		Currencies      []*Currency
-		DefaultCurrency *Currency
-		BudgetCurrency  *Currency
-		DefaultDate     time.Time
-		Mock            string
-	}{
-		Accounts:        formAccounts,       // All accounts for the form dropdown
-		BalanceAccounts: balanceAccounts,    // Only visible accounts for the balances section
-		Categories:      data.AllCategories, // Use AllCategories to include transfer options
-		Transactions:    transactions,
-		Currencies:      app.Currencies,
-		DefaultCurrency: app.DefaultCurrency,
-		BudgetCurrency:  app.BudgetCurrency,
-		DefaultDate:     time.Now(),
-		Mock:            mock,
+	// Categories, including transfer options, with what's left in each
+	categories := make([]*YNABCategoryViewModel, 0, len(data.AllCategories))
+	var budgetedCategories []*YNABCategoryViewModel
+	for _, c := range data.AllCategories {
+		vm := &YNABCategoryViewModel{
+			YNABCategory: c,
+		}
+		if !c.IsTransfer {
+			if app.SecondaryCurrency != nil {
+				if m, err := app.Convert(c.Balance, app.BudgetCurrency, app.SecondaryCurrency, time.Now()); err == nil {
+					vm.SecondaryBalance = &m
+				}
+			}
+			budgetedCategories = append(budgetedCategories, vm)
+		}
+		categories = append(categories, vm)
+	}
+
+	return &pageData{
+		Accounts:           formAccounts,    // All accounts for the form dropdown
+		BalanceAccounts:    balanceAccounts, // Only visible accounts for the balances section
+		Categories:         categories,
+		BudgetedCategories: budgetedCategories, // Only real categories for the category balances section
+		Payees:             app.payeeOptions(data),
+		Transactions:       transactions,
+		Currencies:         app.Currencies,
+		DefaultCurrency:    app.DefaultCurrency,
+		BudgetCurrency:     app.BudgetCurrency,
+		AmountPattern:      app.AmountPattern(),
+		BasePath:           app.BasePath,
+		HasAudit:           app.Audit != nil,
+		HasReceipts:        app.Receipts != nil,
+		Receipts:           app.receiptsOf(transactions...),
+		Mock:               mock,
 	}
+}
 
+func (app *App) renderPage(w http.ResponseWriter, status int, templateName string, data any) error {
 	var buf1 strings.Builder
-	err = tmpl.ExecuteTemplate(&buf1, "index.html", output)
+	err := tmpl.ExecuteTemplate(&buf1, templateName, data)
 	if err != nil {
 		return err
 	}
 
 	templateData := struct {
-		Title   string
-		Content template.HTML
+		Title    string
+		BasePath string
+		Nonce    string
+		Content  template.HTML
 	}{
-		Title:   appCfg.PageTitle,
-		Content: template.HTML(buf1.String()),
+		Title:    app.Config.PageTitle,
+		BasePath: app.BasePath,
+		Nonce:    newCSPNonce(),
+		Content:  template.HTML(buf1.String()),
 	}
 
 	var buf2 bytes.Buffer
@@ -150,115 +245,331 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy(templateData.Nonce))
+	w.WriteHeader(status)
 	_, err = w.Write(buf2.Bytes())
 	return err
 }
 
+func mockQuery(mock string) string {
+	return "?mock=" + url.QueryEscape(mock)
+}
+
+// loadData returns the YNAB data, limited to what the logged-in user may see
+func (app *App) loadData(ctx context.Context, mock string) (*YNABData, error) {
+	data, err := app.cache().load(ctx, app.Config, mock, app.auditSync)
+	if err != nil {
+		return nil, err
+	}
+	return userFrom(ctx).visibleData(data), nil
+}
+
+func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+
+	output := app.newPageData(data, mock)
+	output.Presets = app.presets(data, mock)
+	output.Notice = app.cache().notice()
+	output.Form = app.newExpenseForm()
+	output.Form.prefill(r.URL.Query())
+	output.User = userFrom(r.Context())
+	return app.renderPage(w, http.StatusOK, "index.html", output)
+}
+
 func (app *App) handleRefresh(w http.ResponseWriter, r *http.Request) error {
-	clearCache()
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	app.cache().expire()
+	http.Redirect(w, r, app.BasePath+"/", http.StatusSeeOther)
 	return nil
 }
 
+// parseRequestForm parses the form, which is multipart when it comes with
+// receipt photos
+func parseRequestForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReceiptSize)
+	err := r.ParseMultipartForm(1 << 20)
+	if errors.Is(err, http.ErrNotMultipart) {
+		return nil // the plain form is parsed by then
+	}
+	return err
+}
+
 func (app *App) handleEnterExpense(w http.ResponseWriter, r *http.Request) error {
-	err := r.ParseForm()
+	err := parseRequestForm(w, r)
 	if err != nil {
 		return err
 	}
 
-	form := r.Form
 	mock := r.FormValue("mock")
 
-	data, err := loadYNABDataWithCaching(r.Context(), mock, false)
+	data, err := app.loadData(r.Context(), mock)
 	if err != nil {
 		return err
 	}
 
-	// Extract fields
-	dateStr := form.Get("date")
-	catID := form.Get("category")
-	accID := form.Get("account")
-	comment := strings.TrimSpace(form.Get("comment"))
-	amountStr := form.Get("amount")
-	currencyCode := form.Get("currency")
+	// Uploaded photos are kept in the form when it's shown again
+	err = app.saveReceipts(r)
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "enter", Outcome: auditInvalid, Error: verr.Error()})
+		output := app.newPageData(data, mock)
+		output.Form = app.newExpenseForm().withSubmitted(r.Form, verr.Fields)
+		return app.renderPage(w, http.StatusUnprocessableEntity, "index.html", output)
+	} else if err != nil {
+		return err
+	}
+
+	// "Add split line" re-renders the form with one more empty row
+	if r.Form.Has("add_split") {
+		output := app.newPageData(data, mock)
+		output.Form = app.newExpenseForm().withSubmitted(r.Form, nil)
+		output.Form.SplitOpen = true
+		return app.renderPage(w, http.StatusUnprocessableEntity, "index.html", output)
+	}
 
-	if dateStr == "" {
-		// default to today
-		dateStr = time.Now().Format("2006-01-02")
+	tx, err := app.parseExpenseForm(data, r.Form)
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "enter", Outcome: auditInvalid, Error: verr.Error()})
+		output := app.newPageData(data, mock)
+		output.Form = app.newExpenseForm().withSubmitted(r.Form, verr.Fields)
+		return app.renderPage(w, http.StatusUnprocessableEntity, "index.html", output)
+	} else if err != nil {
+		return err
 	}
 
-	amountVal, err := strconv.ParseFloat(strings.TrimSpace(amountStr), 64)
+	result, err := app.enterTransaction(r, data, tx, mock)
 	if err != nil {
 		return err
 	}
-	amount := Amount(amountVal * 1000)
+	if result.Duplicate != nil {
+		// Ask for confirmation before entering what looks like the same expense twice
+		output := app.newPageData(data, mock)
+		output.Form = app.newExpenseForm().withSubmitted(r.Form, nil)
+		output.Form.Duplicate = result.Duplicate
+		return app.renderPage(w, http.StatusConflict, "index.html", output)
+	}
+	http.Redirect(w, r, app.BasePath+"/"+mockQuery(mock)+transactionAnchor(result.TxID), http.StatusSeeOther)
+	return nil
+}
+
+// enterResult tells what enterTransaction did
+type enterResult struct {
+	TxID      string           // of the entered transaction, empty if unknown
+	Replayed  bool             // the submission was entered before
+	Duplicate *YNABTransaction // a similar transaction exists, nothing entered
+}
+
+// enterTransaction sends a new transaction built from the submitted form to
+// YNAB. A submission with a token seen before is not entered again, and
+// neither is one that looks like an existing transaction unless the form
+// has allow_duplicate.
+func (app *App) enterTransaction(r *http.Request, data *YNABData, tx *YNABTransaction, mock string) (*enterResult, error) {
+	receipts := r.Form["receipt_name"]
+	tx.Comment = withAuthor(app.withReceiptLinks(r, tx.Comment, receipts), userFrom(r.Context()))
+
+	token := r.Form.Get("token")
+	if existing := data.TransactionByImportID(token); existing != nil {
+		log.Printf("Replayed submission %s, transaction %s already in YNAB", token, existing.ID)
+		app.audit(r, &AuditEntry{Action: "enter", Outcome: auditReplay, TransactionID: existing.ID})
+		return &enterResult{TxID: existing.ID, Replayed: true}, nil
+	}
+	if token != "" {
+		txID, fresh, err := recentSubmissions.begin(r.Context(), token)
+		if err != nil {
+			return nil, err
+		}
+		if !fresh {
+			log.Printf("Replayed submission %s, transaction %s already entered", token, txID)
+			app.audit(r, &AuditEntry{Action: "enter", Outcome: auditReplay, TransactionID: txID})
+			return &enterResult{TxID: txID, Replayed: true}, nil
+		}
+		tx.ImportID = token
+	}
 
-	if currencyCode != app.BudgetCurrency.Code {
-		currency := app.CurrenciesByCode[currencyCode]
-		if currency == nil {
-			return fmt.Errorf("currency %q not found", currencyCode)
+	if dup := data.SimilarTransaction(tx); dup != nil && r.Form.Get("allow_duplicate") == "" {
+		if token != "" {
+			recentSubmissions.abort(token)
 		}
+		e := app.auditTransaction("enter", r, tx)
+		e.Outcome, e.Error = auditDuplicate, "similar to transaction "+dup.ID
+		app.audit(r, e)
+		return &enterResult{Duplicate: dup}, nil
+	}
 
-		amountComment := FormatAmount(amount, currency, true)
-		if comment == "" {
-			comment = amountComment
-		} else {
-			comment = fmt.Sprintf("%s %s", amountComment, comment)
+	if mock == "" {
+		err := CreateYNABTransaction(context.Background(), app.Config, data, tx)
+		if callErr := (*httpcall.Error)(nil); errors.As(err, &callErr) && callErr.StatusCode == http.StatusConflict {
+			// YNAB already has a transaction with this import_id, e.g. entered
+			// before a restart wiped recentSubmissions; resync to show it.
+			log.Printf("YNAB reports duplicate import_id %s", token)
+			app.audit(r, &AuditEntry{Action: "enter", Outcome: auditReplay, Error: "YNAB already has import_id " + token})
+			recentSubmissions.finish(token, "")
+			app.cache().expire()
+			return &enterResult{Replayed: true}, nil
+		} else if err != nil {
+			if token != "" {
+				recentSubmissions.abort(token)
+			}
+			e := app.auditTransaction("enter", r, tx)
+			e.Outcome, e.Error = auditError, err.Error()
+			app.audit(r, e)
+			return nil, err
 		}
+	}
+	if token != "" {
+		recentSubmissions.finish(token, tx.ID)
+	}
+	app.linkReceipts(tx.ID, receipts)
+	e := app.auditTransaction("enter", r, tx)
+	e.Outcome = auditOK
+	app.audit(r, e)
 
-		amount = app.ConvertAmount(amount, currency, app.BudgetCurrency).RoundedUpToDeciCents()
+	// Add transaction to the cache, including transfer info if applicable
+	app.cache().appendTransaction(tx)
+	return &enterResult{TxID: tx.ID}, nil
+}
+
+// transactionAnchor returns the URL fragment pointing at the transaction's
+// card in the history list.
+func transactionAnchor(txID string) string {
+	if txID == "" {
+		return ""
 	}
+	return "#tx-" + txID
+}
 
-	account := data.AccountByID(accID)
-	if account == nil {
-		return fmt.Errorf("account %q not found", accID)
+func (app *App) handleEditExpense(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
 	}
 
-	category := data.CategoryByID(catID)
-	if category == nil {
-		return fmt.Errorf("category %q not found", catID)
+	tx := data.TransactionByID(r.PathValue("id"))
+	if tx == nil {
+		http.NotFound(w, r)
+		return nil
 	}
 
-	// Create transaction object
-	tx := YNABTransaction{
-		Date:     dateStr,
-		Category: category,
-		Account:  account,
-		Comment:  comment,
-		Amount:   amount,
+	if tx.IsSplit() {
+		// YNAB's API cannot update the parts of an existing split
+		http.Error(w, "Split transactions cannot be edited, delete and enter it again instead.", http.StatusConflict)
+		return nil
 	}
 
-	// Handle transfer-specific fields
-	if category.IsTransferCategory() {
-		tx.IsTransfer = true
+	output := app.newPageData(data, mock)
+	output.Form = app.editForm(tx)
+	return app.renderPage(w, http.StatusOK, "edit.html", output)
+}
 
-		// Find the target account for the transfer
-		targetID := category.TransferTargetID()
-		for _, a := range data.Accounts {
-			if a.ID == targetID {
-				tx.TransferAccount = a
-				break
-			}
-		}
+func (app *App) handleUpdateExpense(w http.ResponseWriter, r *http.Request) error {
+	err := parseRequestForm(w, r)
+	if err != nil {
+		return err
+	}
 
-		// Clean up transfer comments to prevent duplication
-		// If no comment provided for a transfer, leave it empty
-		// YNAB will automatically display it as a transfer
-		if comment == "" {
-			tx.Comment = ""
-		}
+	mock := r.FormValue("mock")
+
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+
+	old := data.TransactionByID(r.PathValue("id"))
+	if old == nil {
+		http.NotFound(w, r)
+		return nil
+	} else if old.IsSplit() {
+		http.Error(w, "Split transactions cannot be edited, delete and enter it again instead.", http.StatusConflict)
+		return nil
 	}
 
+	var tx *YNABTransaction
+	err = app.saveReceipts(r)
+	if err == nil {
+		tx, err = app.parseExpenseForm(data, r.Form)
+	}
+	if verr := (*ValidationError)(nil); errors.As(err, &verr) {
+		app.audit(r, &AuditEntry{Action: "update", Outcome: auditInvalid, TransactionID: old.ID, Error: verr.Error()})
+		output := app.newPageData(data, mock)
+		output.Form = app.editForm(old).withSubmitted(r.Form, verr.Fields)
+		return app.renderPage(w, http.StatusUnprocessableEntity, "edit.html", output)
+	} else if err != nil {
+		return err
+	}
+	if err := app.updateTransaction(r, data, old, tx, mock); err != nil {
+		return err
+	}
+	http.Redirect(w, r, app.BasePath+"/"+mockQuery(mock), http.StatusSeeOther)
+	return nil
+}
+
+// updateTransaction replaces an existing transaction in YNAB with the one
+// built from the submitted form
+func (app *App) updateTransaction(r *http.Request, data *YNABData, old, tx *YNABTransaction, mock string) error {
+	tx.ID = old.ID
+	receipts := r.Form["receipt_name"]
+	tx.Comment = withAuthor(app.withReceiptLinks(r, tx.Comment, receipts), userFrom(r.Context()))
+
+	var err error
 	if mock == "" {
-		err = CreateYNABTransaction(context.Background(), &appCfg, data, &tx)
-		if err != nil {
-			return err
-		}
+		err = UpdateYNABTransaction(r.Context(), app.Config, data, tx)
+	}
+	e := app.auditTransaction("update", r, tx)
+	if err != nil {
+		e.Outcome, e.Error = auditError, err.Error()
+		app.audit(r, e)
+		return err
+	}
+	e.Outcome = auditOK
+	app.audit(r, e)
+	if mock == "" {
+		app.linkReceipts(tx.ID, receipts)
 	}
 
-	// Add transaction to the cache, including transfer info if applicable
-	appendTransactionToCachedData(&tx)
+	app.cache().replaceTransaction(tx)
+	return nil
+}
+
+func (app *App) handleDeleteExpense(w http.ResponseWriter, r *http.Request) error {
+	mock := r.FormValue("mock")
+
+	data, err := app.loadData(r.Context(), mock)
+	if err != nil {
+		return err
+	}
+
+	tx := data.TransactionByID(r.PathValue("id"))
+	if tx == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	if err := app.deleteTransaction(r, data, tx, mock); err != nil {
+		return err
+	}
+	http.Redirect(w, r, app.BasePath+"/"+mockQuery(mock), http.StatusSeeOther)
+	return nil
+}
+
+func (app *App) deleteTransaction(r *http.Request, data *YNABData, tx *YNABTransaction, mock string) error {
+	var err error
+	if mock == "" {
+		err = DeleteYNABTransaction(r.Context(), app.Config, data, tx.ID)
+	}
+	e := &AuditEntry{Action: "delete", Outcome: auditOK, TransactionID: tx.ID, Amount: tx.Amount}
+	if err != nil {
+		e.Outcome, e.Error = auditError, err.Error()
+	}
+	app.audit(r, e)
+	if err != nil {
+		return err
+	}
 
-	http.Redirect(w, r, "/?mock="+url.QueryEscape(mock), http.StatusSeeOther)
+	app.cache().removeTransaction(tx.ID)
 	return nil
 }
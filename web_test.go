@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestIndex_simple(t *testing.T) {
-	appCfg = AppConfig{
+	cfg := &AppConfig{
 		PageTitle: "Test Expenses",
 		Currencies: []CurrencyConfig{
 			{Code: "USD", Rate: 1.0, Format: "$%0.2f"},
@@ -17,7 +21,8 @@ func TestIndex_simple(t *testing.T) {
 		BudgetCurrency:  "USD",
 		DefaultCurrency: "GEL",
 	}
-	app, err := New(&appCfg)
+	clearCache()
+	app, err := New(cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,3 +54,440 @@ func TestIndex_simple(t *testing.T) {
 		t.Errorf("Expected mock transaction 'Milk' in output")
 	}
 }
+
+func newFakeYNABApp(t *testing.T) *App {
+	_, cfg := newSeededFakeYNAB(t)
+	cfg.PageTitle = "Test Expenses"
+	cfg.Currencies = []CurrencyConfig{
+		{Code: "USD", Rate: 1.0, Format: "$9.99"},
+		{Code: "GEL", Rate: 2.5, Format: "₾9.99"},
+	}
+	cfg.BudgetCurrency = "USD"
+	cfg.DefaultCurrency = "GEL"
+	clearCache()
+	t.Cleanup(clearCache)
+
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func postForm(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) error, path, id string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	if err := handler(w, req); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func getPage(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) error, path, id string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	if err := handler(w, req); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d", path, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestFormatAmount(t *testing.T) {
+	two, zero, three := 2, 0, 3
+	newTestCurrency := func(c CurrencyConfig) *Currency {
+		currency, err := newCurrency(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return currency
+	}
+	usd := newTestCurrency(CurrencyConfig{Code: "USD", Rate: 1, Format: "$9.99", GroupSeparator: ","})
+	gel := newTestCurrency(CurrencyConfig{Code: "GEL", Rate: 2.6, Decimals: &two, DecimalSeparator: ",", GroupSeparator: " ", Symbol: "₾", SymbolPosition: "after", SymbolSpace: true})
+	jpy := newTestCurrency(CurrencyConfig{Code: "JPY", Rate: 150, Decimals: &zero, Symbol: "¥"})
+	kwd := newTestCurrency(CurrencyConfig{Code: "KWD", Rate: 0.3, Decimals: &three, Symbol: "KD", SymbolSpace: true})
+
+	tests := []struct {
+		currency *Currency
+		amount   Amount
+		brief    bool
+		expected string
+	}{
+		{usd, 1_234_560, false, "$1,234.56"},
+		{usd, -8_000, false, "$-8.00"},
+		{usd, 25_000, true, "$25"},
+		{usd, 1_234_500, true, "$1234.50"},
+		{gel, 1_234_560, false, "1 234,56 ₾"},
+		{gel, 999, false, "1,00 ₾"},
+		{gel, 25_000, true, "25 ₾"},
+		{jpy, 1_500, false, "¥2"},
+		{jpy, 2_500, false, "¥2"},
+		{jpy, 1_234_000, false, "¥1234"},
+		{kwd, 1_234, false, "KD 1.234"},
+	}
+	for _, tt := range tests {
+		if actual := FormatAmount(tt.amount, tt.currency, tt.brief); actual != tt.expected {
+			t.Errorf("FormatAmount(%d, %s, %v) = %q, wanted %q", tt.amount, tt.currency.Code, tt.brief, actual, tt.expected)
+		}
+	}
+
+	// Memos written in a currency's format are recognized when editing
+	app := &App{Currencies: []*Currency{usd, gel, jpy}, BudgetCurrency: usd}
+	currency, amount, rest, ok := app.parseAmountComment(FormatAmount(1_234_500, gel, true) + " @2.6 Cat litter")
+	if !ok || currency != gel || amount != "1234,50" || rest != "Cat litter" {
+		t.Errorf("parseAmountComment = %v, %q, %q, %v", currency, amount, rest, ok)
+	}
+	if pattern := app.AmountPattern(); pattern != "[0-9]*([., ][0-9]+)*" {
+		t.Errorf("AmountPattern() = %q", pattern)
+	}
+}
+
+func TestEnterExpense_fakeYNAB(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	w := postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+		"date":     {"2025-02-01"},
+		"amount":   {"25"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C2"},
+		"comment":  {"Cat litter"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+
+	// Force a delta sync so that the page shows what YNAB has
+	app.cache().expire()
+	body := getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, "₾25 @2.5 Cat litter") {
+		t.Errorf("Expected entered transaction in output")
+	}
+	if !strings.Contains(body, "$81.00") {
+		t.Errorf("Expected updated Cash balance $81.00 in output")
+	}
+}
+
+func TestCategoryBalances(t *testing.T) {
+	app := newFakeYNABApp(t)
+	app.SecondaryCurrency = app.DefaultCurrency
+	ctx := context.Background()
+
+	data, err := app.loadData(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groceries := *data.CategoryByID("C1")
+	if groceries.Budgeted != 200_000 {
+		t.Fatalf("Groceries = %+v", groceries)
+	}
+
+	postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+		"date":     {time.Now().Format("2006-01-02")},
+		"amount":   {"10"},
+		"currency": {"USD"},
+		"account":  {"A1"},
+		"category": {"C1"},
+	})
+
+	// Updated right away, and YNAB agrees after a sync
+	for _, sync := range []bool{false, true} {
+		if sync {
+			app.cache().expire()
+		}
+		data, err := app.loadData(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := data.CategoryByID("C1")
+		if c.Balance != groceries.Balance-10_000 || c.Activity != groceries.Activity-10_000 {
+			t.Errorf("after sync=%v: balance %v, activity %v; wanted %v, %v", sync, c.Balance, c.Activity, groceries.Balance-10_000, groceries.Activity-10_000)
+		}
+	}
+
+	body := getPage(t, app.handleIndex, "/", "")
+	remaining := FormatAmount(groceries.Balance-10_000, app.BudgetCurrency, false)
+	if !strings.Contains(body, "Groceries · "+remaining+" / ₾") {
+		t.Errorf("Expected the remaining %s next to the Groceries option", remaining)
+	}
+}
+
+func TestEnterExpense_payee(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	// The seeded expenses are all paid to Corner Market, the latest from Groceries
+	body := getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, `<option value="Corner Market" data-account="A1" data-category="C1" data-currency="USD">`) {
+		t.Errorf("Expected Corner Market in the payee suggestions with its defaults")
+	}
+
+	enter := func(amount, payee, comment string) {
+		t.Helper()
+		w := postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+			"date":     {"2025-02-01"},
+			"amount":   {amount},
+			"currency": {"GEL"},
+			"account":  {"A2"},
+			"category": {"C2"},
+			"payee":    {payee},
+			"comment":  {comment},
+		})
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("Expected 303, got %d", w.Code)
+		}
+	}
+	enter("25", "corner market", "Known payee")
+	enter("30", "Riverside Vet", "New payee")
+
+	app.cache().expire()
+	data, err := app.loadData(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payees := make(map[string]*YNABTransaction)
+	for _, tx := range data.Transactions {
+		payees[app.withoutAuthor(tx.Comment)] = tx
+	}
+	if tx := payees["₾25 @2.5 Known payee"]; tx == nil || tx.PayeeID != "P1" || tx.PayeeName != "Corner Market" {
+		t.Errorf("known payee transaction = %+v", tx)
+	}
+	if tx := payees["₾30 @2.5 New payee"]; tx == nil || tx.PayeeID == "" || tx.PayeeName != "Riverside Vet" {
+		t.Errorf("new payee transaction = %+v", tx)
+	}
+	if data.PayeeByName("Riverside Vet") == nil {
+		t.Errorf("Expected Riverside Vet among the payees")
+	}
+
+	body = getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, `<option value="Riverside Vet" data-account="A2" data-category="C2" data-currency="GEL">`) {
+		t.Errorf("Expected Riverside Vet to suggest the account, category and currency used")
+	}
+}
+
+func TestEditAndDeleteExpense_fakeYNAB(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	body := getPage(t, app.handleEditExpense, "/transactions/T1/edit", "T1")
+	if !strings.Contains(body, `value="1.5"`) || !strings.Contains(body, `value="Sample expense 1"`) {
+		t.Errorf("Expected edit form prefilled with T1 values")
+	}
+
+	w := postForm(t, app.handleUpdateExpense, "/transactions/T1", "T1", url.Values{
+		"date":     {"2025-02-01"},
+		"amount":   {"10"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C1"},
+		"comment":  {"Fixed"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+
+	body = getPage(t, app.handleEditExpense, "/transactions/T1/edit", "T1")
+	if !strings.Contains(body, `value="10"`) || !strings.Contains(body, `value="Fixed"`) || !strings.Contains(body, `value="GEL" selected`) {
+		t.Errorf("Expected edit form to show the GEL amount and comment")
+	}
+
+	postForm(t, app.handleDeleteExpense, "/transactions/T2/delete", "T2", nil)
+
+	// Cached balance: 91.00 + 1.50 - 4.00 + 3.00
+	body = getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, "$91.50") || strings.Contains(body, "Sample expense 2") {
+		t.Errorf("Expected cached data updated after edit and delete")
+	}
+
+	app.cache().expire()
+	body = getPage(t, app.handleIndex, "/", "")
+	if !strings.Contains(body, "$91.50") || !strings.Contains(body, "₾10 @2.5 Fixed") || strings.Contains(body, "Sample expense 2") {
+		t.Errorf("Expected YNAB data updated after edit and delete")
+	}
+}
+
+func TestEnterExpense_validation(t *testing.T) {
+	cfg := &AppConfig{
+		PageTitle: "Test Expenses",
+		Currencies: []CurrencyConfig{
+			{Code: "USD", Rate: 1.0, Format: "$9.99"},
+			{Code: "GEL", Rate: 2.6, Format: "₾9.99"},
+		},
+		BudgetCurrency:  "USD",
+		DefaultCurrency: "GEL",
+	}
+	clearCache()
+	t.Cleanup(clearCache)
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := url.Values{
+		"mock":     {"simple"},
+		"date":     {"2025-02-01"},
+		"amount":   {"12.50"},
+		"currency": {"GEL"},
+		"account":  {"A2"},
+		"category": {"C1"},
+		"comment":  {"Cat food"},
+	}
+	tests := []struct {
+		field, value, message string
+	}{
+		{"amount", "12,5o", "Enter a number like 12.50."},
+		{"amount", "", "Enter an amount."},
+		{"category", "", "Choose a category."},
+		{"category", "C99", "This category is no longer available."},
+		{"currency", "EUR", "Unknown currency &#34;EUR&#34;."},
+		{"account", "A99", "Choose an account."},
+		{"date", "01/02/2025", "Enter a valid date."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field+"="+tt.value, func(t *testing.T) {
+			form := maps.Clone(valid)
+			form.Set(tt.field, tt.value)
+
+			w := postForm(t, app.handleEnterExpense, "/enter", "", form)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("Expected 422, got %d", w.Code)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, tt.message) {
+				t.Errorf("Expected message %q in output", tt.message)
+			}
+			if !strings.Contains(body, `value="Cat food"`) {
+				t.Errorf("Expected submitted comment to be kept")
+			}
+			if tt.field != "account" && !strings.Contains(body, `value="A2" selected`) {
+				t.Errorf("Expected submitted account to stay selected")
+			}
+		})
+	}
+
+	w := postForm(t, app.handleEnterExpense, "/enter", "", valid)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303 for a valid form, got %d", w.Code)
+	}
+}
+
+func TestEnterExpense_replayedSubmission(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	form := url.Values{
+		"token":    {newSubmissionToken()},
+		"date":     {"2025-02-01"},
+		"amount":   {"25"},
+		"currency": {"GEL"},
+		"account":  {"A1"},
+		"category": {"C2"},
+		"comment":  {"Cat litter"},
+	}
+	first := postForm(t, app.handleEnterExpense, "/enter", "", form)
+	second := postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if first.Code != http.StatusSeeOther || second.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303 twice, got %d and %d", first.Code, second.Code)
+	}
+	if loc := second.Header().Get("Location"); loc != first.Header().Get("Location") || !strings.Contains(loc, "#tx-") {
+		t.Errorf("Expected replay to redirect to the same transaction, got %q", loc)
+	}
+
+	// A restart forgets the tokens, but YNAB still knows the import_id
+	recentSubmissions = &submissionLog{entries: make(map[string]*submission)}
+	clearCache()
+	third := postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if third.Code != http.StatusSeeOther || third.Header().Get("Location") != first.Header().Get("Location") {
+		t.Fatalf("Expected 303 to the same transaction, got %d %q", third.Code, third.Header().Get("Location"))
+	}
+
+	body := getPage(t, app.handleIndex, "/", "")
+	if n := strings.Count(body, "₾25 @2.5 Cat litter"); n != 1 {
+		t.Errorf("Expected the transaction once, found %d times", n)
+	}
+}
+
+func TestEnterExpense_duplicateWarning(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	// Same as the seeded T1 (Sample expense 1), entered in USD
+	form := url.Values{
+		"token":    {newSubmissionToken()},
+		"date":     {time.Now().AddDate(0, 0, -3).Format("2006-01-02")},
+		"amount":   {"1.50"},
+		"currency": {"USD"},
+		"account":  {"A1"},
+		"category": {"C1"},
+		"comment":  {"Again"},
+	}
+	w := postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "is already entered (Sample expense 1)") || !strings.Contains(body, `name="allow_duplicate"`) {
+		t.Errorf("Expected duplicate warning in output")
+	}
+	if !strings.Contains(body, `value="`+form.Get("token")+`"`) {
+		t.Errorf("Expected submission token to be kept")
+	}
+
+	form.Set("allow_duplicate", "1")
+	w = postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303 after confirming, got %d", w.Code)
+	}
+}
+
+func TestEnterExpense_split(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	form := url.Values{
+		"token":          {newSubmissionToken()},
+		"date":           {"2025-02-01"},
+		"amount":         {"30"},
+		"currency":       {"GEL"},
+		"account":        {"A1"},
+		"comment":        {"Market"},
+		"split_category": {"C1", "C2", ""},
+		"split_amount":   {"20", "5", ""},
+		"split_comment":  {"Vegetables", "Pet food", ""},
+	}
+	w := postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Split lines add up to ₾25.00, not ₾30.00.") {
+		t.Fatalf("Expected split total mismatch error, got %d", w.Code)
+	}
+
+	form.Del("amount")
+	w = postForm(t, app.handleEnterExpense, "/enter", "", form)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, got %d", w.Code)
+	}
+
+	app.cache().expire()
+	body := getPage(t, app.handleIndex, "/", "")
+	for _, s := range []string{"₾25 @2.5 Market", "₾20 @2.5 Vegetables", "$-8.00", "₾5 @2.5 Pet food", "$-2.00", "$81.00"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %q in output", s)
+		}
+	}
+}
+
+func TestEnterExpense_addSplitLine(t *testing.T) {
+	app := newFakeYNABApp(t)
+
+	w := postForm(t, app.handleEnterExpense, "/enter", "", url.Values{
+		"currency":       {"GEL"},
+		"split_category": {"C1", "C2", "C1"},
+		"split_amount":   {"1", "2", "3"},
+		"split_comment":  {"", "", ""},
+		"add_split":      {"1"},
+	})
+	if n := strings.Count(w.Body.String(), `name="split_amount"`); n != 4 {
+		t.Errorf("Expected 4 split lines, got %d", n)
+	}
+}
@@ -2,65 +2,101 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/andreyvit/mvp/httpcall"
 )
 
-func LoadYNABData(ctx context.Context, cfg *AppConfig) (*YNABData, error) {
-	budgetID, err := findBudgetID(ctx, cfg)
+const defaultYNABBaseURL = "https://api.youneedabudget.com/v1/"
+
+func LoadYNABData(ctx context.Context, cfg *AppConfig, prev *YNABData) (*YNABData, error) {
+	data, err := loadYNABData(ctx, cfg, prev)
+	if callErr := (*httpcall.Error)(nil); errors.As(err, &callErr) && callErr.StatusCode == http.StatusNotFound {
+		// The budget is gone or has a new ID, so look it up again
+		forgetBudgetID(cfg)
+		return loadYNABData(ctx, cfg, nil)
+	}
+	return data, err
+}
+
+func loadYNABData(ctx context.Context, cfg *AppConfig, prev *YNABData) (*YNABData, error) {
+	budgetID, err := resolveBudgetID(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
+	state := &YNABSyncState{}
+	if prev != nil && prev.Sync != nil && prev.BudgetID == budgetID {
+		// Incremental sync: only ask YNAB for what changed since last time
+		state = prev.Sync.Clone()
+	} else if prev != nil && prev.Sync != nil {
+		log.Printf("Budget %q is now %s rather than %s, loading it in full", cfg.budgetLabel(), budgetID, prev.BudgetID)
+	}
 
-	accounts, err := loadAccounts(ctx, cfg, budgetID)
+	accounts, knowledge, err := loadAccounts(ctx, cfg, budgetID, state.Knowledge.Accounts)
 	if err != nil {
 		return nil, err
 	}
+	state.Accounts = mergeDelta(state.Accounts, accounts)
+	state.Knowledge.Accounts = knowledge
 
-	categories, err := loadCategories(ctx, cfg, budgetID)
+	payees, knowledge, err := loadPayees(ctx, cfg, budgetID, state.Knowledge.Payees)
 	if err != nil {
 		return nil, err
 	}
+	state.Payees = mergeDelta(state.Payees, payees)
+	state.Knowledge.Payees = knowledge
 
-	// Generate transfer pseudo-categories
-	transferCategories := GenerateTransferCategories(accounts)
-
-	// Combine real categories and transfer categories
-	allCategories := make([]*YNABCategory, 0, len(categories)+len(transferCategories))
-	allCategories = append(allCategories, categories...)
-	allCategories = append(allCategories, transferCategories...)
+	categories, knowledge, err := loadCategories(ctx, cfg, budgetID, state.Knowledge.Categories)
+	if err != nil {
+		return nil, err
+	}
+	state.Categories = mergeDelta(state.Categories, categories)
+	state.Knowledge.Categories = knowledge
 
-	transactions, err := loadAllTransactions(ctx, cfg, budgetID, accounts, categories)
+	transactions, knowledge, err := loadAllTransactions(ctx, cfg, budgetID, state.Knowledge.Transactions)
 	if err != nil {
 		return nil, err
 	}
+	state.Transactions = mergeDelta(state.Transactions, transactions)
+	state.Knowledge.Transactions = knowledge
 
-	return &YNABData{
-		BudgetID:      budgetID,
-		Accounts:      accounts,
-		Categories:    categories,
-		Transactions:  transactions,
-		AllCategories: allCategories,
-	}, nil
+	return buildYNABData(cfg, budgetID, state)
 }
 
-// Create a transaction in YNAB
-func CreateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData, tx *YNABTransaction) error {
+// transactionInput builds the YNAB SaveTransaction payload for tx
+func transactionInput(data *YNABData, tx *YNABTransaction) (map[string]interface{}, error) {
 	// Create the transaction input map
 	txMap := map[string]interface{}{
 		"date":       tx.Date,
-		"amount":     -tx.Amount, // Negative for outflow
+		"amount":     tx.Amount, // Negative for outflow
 		"account_id": tx.Account.ID,
 		"memo":       tx.Comment,
 		"cleared":    "cleared",
 		"approved":   true,
 	}
+	if tx.ImportID != "" {
+		txMap["import_id"] = tx.ImportID
+	}
 
-	// Handle transfer vs regular transaction
-	if tx.Category != nil && tx.Category.IsTransferCategory() {
+	// Handle split vs transfer vs regular transaction
+	if tx.IsSplit() {
+		subs := make([]map[string]interface{}, 0, len(tx.Subtransactions))
+		for _, sub := range tx.Subtransactions {
+			subs = append(subs, map[string]interface{}{
+				"amount":      sub.Amount,
+				"category_id": sub.Category.ID,
+				"memo":        sub.Comment,
+			})
+		}
+		txMap["category_id"] = nil
+		txMap["subtransactions"] = subs
+	} else if tx.Category != nil && tx.Category.IsTransferCategory() {
 		// Get the target account ID from the transfer category
 		targetAccountID := tx.Category.TransferTargetID()
 
@@ -74,7 +110,7 @@ func CreateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData,
 		}
 
 		if targetAccount == nil {
-			return fmt.Errorf("target account %s not found", targetAccountID)
+			return nil, fmt.Errorf("target account %s not found", targetAccountID)
 		}
 
 		// For transfers, use the target account's transfer_payee_id
@@ -90,6 +126,35 @@ func CreateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData,
 		txMap["category_id"] = tx.Category.ID
 	}
 
+	// An unknown payee name makes YNAB create the payee
+	if !tx.IsTransfer {
+		switch {
+		case tx.PayeeID != "":
+			txMap["payee_id"] = tx.PayeeID
+		case tx.PayeeName != "":
+			txMap["payee_name"] = tx.PayeeName
+		default:
+			txMap["payee_id"] = nil
+		}
+	}
+	return txMap, nil
+}
+
+// Create a transaction in YNAB
+func CreateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData, tx *YNABTransaction) error {
+	txMap, err := transactionInput(data, tx)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Data struct {
+			Transaction struct {
+				ID string `json:"id"`
+			} `json:"transaction"`
+		} `json:"data"`
+	}
+
 	// Create the API request
 	req := &httpcall.Request{
 		Context: ctx,
@@ -99,17 +164,55 @@ func CreateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData,
 		Input: map[string]interface{}{
 			"transaction": txMap,
 		},
+		OutputPtr: &resp,
+	}
+	configureCall(req, cfg)
+
+	if err := req.Do(); err != nil {
+		return err
+	}
+	tx.ID = resp.Data.Transaction.ID
+	return nil
+}
+
+// Update an existing transaction in YNAB
+func UpdateYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData, tx *YNABTransaction) error {
+	txMap, err := transactionInput(data, tx)
+	if err != nil {
+		return err
+	}
+
+	req := &httpcall.Request{
+		Context: ctx,
+		CallID:  "UpdateTransaction",
+		Method:  http.MethodPut,
+		Path:    fmt.Sprintf("budgets/%s/transactions/%s", data.BudgetID, tx.ID),
+		Input: map[string]interface{}{
+			"transaction": txMap,
+		},
 	}
 	configureCall(req, cfg)
+	return req.Do()
+}
 
+// Delete a transaction in YNAB
+func DeleteYNABTransaction(ctx context.Context, cfg *AppConfig, data *YNABData, id string) error {
+	req := &httpcall.Request{
+		Context: ctx,
+		CallID:  "DeleteTransaction",
+		Method:  http.MethodDelete,
+		Path:    fmt.Sprintf("budgets/%s/transactions/%s", data.BudgetID, id),
+	}
+	configureCall(req, cfg)
 	return req.Do()
 }
 
 var MockData = map[string]func() *YNABData{
 	"simple": func() *YNABData {
 		// Regular categories
-		c1 := &YNABCategory{ID: "C1", Name: "Groceries"}
-		c2 := &YNABCategory{ID: "C2", Name: "Dining Out"}
+		c1 := &YNABCategory{ID: "C1", Name: "Groceries", Budgeted: 400_000, Activity: -27_450, Balance: 372_550}
+		c2 := &YNABCategory{ID: "C2", Name: "Dining Out", Budgeted: 100_000, Activity: -20_990, Balance: 79_010,
+			GoalType: "MF", GoalTarget: 150_000, GoalPercentageComplete: 66, GoalUnderFunded: 50_000}
 
 		// Accounts - keep "Cash" for test compatibility
 		a1 := &YNABAccount{ID: "A1", Name: "Cash", Balance: 345600, TransferPayeeID: "TP-A1"}              // $345.60
@@ -137,289 +240,152 @@ var MockData = map[string]func() *YNABData{
 			Accounts:      accounts,
 			Categories:    categories,
 			AllCategories: allCategories,
+			Payees:        []*YNABPayee{{ID: "P1", Name: "Corner Market"}, {ID: "P2", Name: "Cafe Ronda"}},
 			Transactions: []*YNABTransaction{
 				// Regular transactions - keep "Milk" for test compatibility
-				{Date: "2025-01-14", Category: c2, Account: a1, Comment: "Lunch meeting", Amount: 12_990},
-				{Date: "2025-01-15", Category: c1, Account: a1, Comment: "Milk", Amount: 3_450},
+				{ID: "T1", Date: "2025-01-14", Category: c2, Account: a1, PayeeID: "P2", PayeeName: "Cafe Ronda", Comment: "Lunch meeting", Amount: -12_990},
+				{ID: "T2", Date: "2025-01-15", Category: c1, Account: a1, PayeeID: "P1", PayeeName: "Corner Market", Comment: "Milk", Amount: -3_450},
+				{ID: "T6", Date: "2025-01-15", Category: SplitCategory, Account: a2, Comment: "Market", Amount: -20_000, Subtransactions: []*YNABSubtransaction{
+					{Category: c1, Comment: "Vegetables", Amount: -12_000},
+					{Category: c2, Comment: "Coffee to go", Amount: -8_000},
+				}},
 
 				// Transfer transactions - using negative amounts to represent outflows
-				{Date: "2025-01-16", Category: transferToA2, Account: a1, Comment: "Moving funds", Amount: -50_000, IsTransfer: true, TransferAccount: a2},
-				{Date: "2025-01-17", Category: transferToA3, Account: a2, Comment: "", Amount: -75_000, IsTransfer: true, TransferAccount: a3},
-				{Date: "2025-01-18", Category: transferToA1, Account: a3, Comment: "Reimbursement", Amount: -35_000, IsTransfer: true, TransferAccount: a1},
+				{ID: "T3", Date: "2025-01-16", Category: transferToA2, Account: a1, Comment: "Moving funds", Amount: -50_000, IsTransfer: true, TransferAccount: a2},
+				{ID: "T4", Date: "2025-01-17", Category: transferToA3, Account: a2, Comment: "", Amount: -75_000, IsTransfer: true, TransferAccount: a3},
+				{ID: "T5", Date: "2025-01-18", Category: transferToA1, Account: a3, Comment: "Reimbursement", Amount: -35_000, IsTransfer: true, TransferAccount: a1},
 			},
 		}
 	},
 }
 
-func findBudgetID(ctx context.Context, cfg *AppConfig) (string, error) {
-	var resp struct {
-		Data struct {
-			Budgets []struct {
-				ID   string `json:"id"`
-				Name string `json:"name"`
-			} `json:"budgets"`
-		} `json:"data"`
-	}
-	req := &httpcall.Request{
-		Context:   ctx,
-		CallID:    "ListBudgets",
-		Method:    http.MethodGet,
-		Path:      "budgets",
-		OutputPtr: &resp,
+// deltaQuery returns query params asking YNAB only for changes made after
+// the given server knowledge, or nil for a full load.
+func deltaQuery(knowledge int64) url.Values {
+	if knowledge == 0 {
+		return nil
 	}
-	configureCall(req, cfg)
-	if err := req.Do(); err != nil {
-		return "", err
-	}
-	for _, b := range resp.Data.Budgets {
-		if b.Name == cfg.BudgetName {
-			return b.ID, nil
-		}
-	}
-	return "", fmt.Errorf("budget named %q not found in YNAB", cfg.BudgetName)
+	return url.Values{"last_knowledge_of_server": {strconv.FormatInt(knowledge, 10)}}
 }
 
-func loadAccounts(ctx context.Context, cfg *AppConfig, budgetID string) ([]*YNABAccount, error) {
+func loadAccounts(ctx context.Context, cfg *AppConfig, budgetID string, knowledge int64) ([]*apiAccount, int64, error) {
 	var resp struct {
 		Data struct {
-			Accounts []*YNABAccount `json:"accounts"`
+			Accounts        []*apiAccount `json:"accounts"`
+			ServerKnowledge int64         `json:"server_knowledge"`
 		} `json:"data"`
 	}
 	req := &httpcall.Request{
-		Context:   ctx,
-		CallID:    "ListAccounts",
-		Method:    http.MethodGet,
-		Path:      fmt.Sprintf("budgets/%s/accounts", budgetID),
-		OutputPtr: &resp,
+		Context:     ctx,
+		CallID:      "ListAccounts",
+		Method:      http.MethodGet,
+		Path:        fmt.Sprintf("budgets/%s/accounts", budgetID),
+		QueryParams: deltaQuery(knowledge),
+		OutputPtr:   &resp,
 	}
 	configureCall(req, cfg)
 	if err := req.Do(); err != nil {
-		return nil, err
-	}
-
-	// Load payees to get transfer_payee_ids
-	payeesMap, err := loadPayeesForAccounts(ctx, cfg, budgetID)
-	if err != nil {
-		return nil, err
-	}
-
-	// Associate transfer payees with accounts
-	for _, a := range resp.Data.Accounts {
-		if payeeID, ok := payeesMap[a.ID]; ok {
-			a.TransferPayeeID = payeeID
-		}
+		return nil, 0, err
 	}
-
-	accountsByName := make(map[string]*YNABAccount)
-	for _, a := range resp.Data.Accounts {
-		accountsByName[a.Name] = a
-	}
-
-	var result []*YNABAccount
-	for _, name := range cfg.Accounts {
-		if a, ok := accountsByName[name]; ok {
-			result = append(result, a)
-		} else {
-			return nil, fmt.Errorf("account named %q not found", name)
-		}
-	}
-	return result, nil
+	return resp.Data.Accounts, resp.Data.ServerKnowledge, nil
 }
 
-// loadPayeesForAccounts loads all payees and returns a map of account ID to transfer payee ID
-func loadPayeesForAccounts(ctx context.Context, cfg *AppConfig, budgetID string) (map[string]string, error) {
+// loadPayees loads payees; transfer payees are later matched to accounts, and
+// the rest are offered in the form
+func loadPayees(ctx context.Context, cfg *AppConfig, budgetID string, knowledge int64) ([]*apiPayee, int64, error) {
 	var resp struct {
 		Data struct {
-			Payees []struct {
-				ID                string `json:"id"`
-				Name              string `json:"name"`
-				TransferAccountID string `json:"transfer_account_id"`
-			} `json:"payees"`
+			Payees          []*apiPayee `json:"payees"`
+			ServerKnowledge int64       `json:"server_knowledge"`
 		} `json:"data"`
 	}
 
 	req := &httpcall.Request{
-		Context:   ctx,
-		CallID:    "ListPayees",
-		Method:    http.MethodGet,
-		Path:      fmt.Sprintf("budgets/%s/payees", budgetID),
-		OutputPtr: &resp,
+		Context:     ctx,
+		CallID:      "ListPayees",
+		Method:      http.MethodGet,
+		Path:        fmt.Sprintf("budgets/%s/payees", budgetID),
+		QueryParams: deltaQuery(knowledge),
+		OutputPtr:   &resp,
 	}
 	configureCall(req, cfg)
 	if err := req.Do(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	// Map of account ID to transfer payee ID
-	accountToPayeeID := make(map[string]string)
-
-	// Process each payee
-	for _, p := range resp.Data.Payees {
-		if p.TransferAccountID != "" {
-			// This is a transfer payee
-			accountToPayeeID[p.TransferAccountID] = p.ID
-		}
-	}
-
-	return accountToPayeeID, nil
+	return resp.Data.Payees, resp.Data.ServerKnowledge, nil
 }
 
-func loadCategories(ctx context.Context, cfg *AppConfig, budgetID string) ([]*YNABCategory, error) {
+func loadCategories(ctx context.Context, cfg *AppConfig, budgetID string, knowledge int64) ([]*apiCategory, int64, error) {
 	var resp struct {
 		Data struct {
 			CategoryGroups []struct {
-				Categories []*YNABCategory `json:"categories"`
+				Categories []*apiCategory `json:"categories"`
 			} `json:"category_groups"`
+			ServerKnowledge int64 `json:"server_knowledge"`
 		} `json:"data"`
 	}
 
 	req := &httpcall.Request{
-		Context:   ctx,
-		CallID:    "ListCategories",
-		Method:    http.MethodGet,
-		Path:      fmt.Sprintf("budgets/%s/categories", budgetID),
-		OutputPtr: &resp,
+		Context:     ctx,
+		CallID:      "ListCategories",
+		Method:      http.MethodGet,
+		Path:        fmt.Sprintf("budgets/%s/categories", budgetID),
+		QueryParams: deltaQuery(knowledge),
+		OutputPtr:   &resp,
 	}
 	configureCall(req, cfg)
 	if err := req.Do(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	categoriesByName := make(map[string]*YNABCategory)
+	var result []*apiCategory
 	for _, cg := range resp.Data.CategoryGroups {
-		for _, c := range cg.Categories {
-			categoriesByName[c.Name] = c
-		}
-	}
-
-	var result []*YNABCategory
-	for _, name := range cfg.Categories {
-		if c, ok := categoriesByName[name]; ok {
-			result = append(result, c)
-		} else {
-			return nil, fmt.Errorf("category named %q not found", name)
-		}
+		result = append(result, cg.Categories...)
 	}
-	return result, nil
+	return result, resp.Data.ServerKnowledge, nil
 }
 
-func loadAllTransactions(
-	ctx context.Context,
-	cfg *AppConfig,
-	budgetID string,
-	accounts []*YNABAccount,
-	categories []*YNABCategory,
-) ([]*YNABTransaction, error) {
+func loadAllTransactions(ctx context.Context, cfg *AppConfig, budgetID string, knowledge int64) ([]*apiTransaction, int64, error) {
 	var resp struct {
 		Data struct {
-			Transactions []struct {
-				ID                    string `json:"id"`
-				AccountID             string `json:"account_id"`
-				CategoryID            string `json:"category_id"`
-				Date                  string `json:"date"`
-				Memo                  string `json:"memo"`
-				Amount                Amount `json:"amount"` // milliunits in YNAB
-				TransferAccountID     string `json:"transfer_account_id"`
-				PayeeID               string `json:"payee_id"`
-				PayeeName             string `json:"payee_name"`
-				TransferTransactionID string `json:"transfer_transaction_id"`
-			} `json:"transactions"`
+			Transactions    []*apiTransaction `json:"transactions"`
+			ServerKnowledge int64             `json:"server_knowledge"`
 		} `json:"data"`
 	}
 	req := &httpcall.Request{
-		Context:   ctx,
-		CallID:    "ListTransactions",
-		Method:    http.MethodGet,
-		Path:      fmt.Sprintf("budgets/%s/transactions", budgetID),
-		OutputPtr: &resp,
+		Context:     ctx,
+		CallID:      "ListTransactions",
+		Method:      http.MethodGet,
+		Path:        fmt.Sprintf("budgets/%s/transactions", budgetID),
+		QueryParams: deltaQuery(knowledge),
+		OutputPtr:   &resp,
 	}
 	configureCall(req, cfg)
 	if err := req.Do(); err != nil {
-		return nil, err
-	}
-
-	accountsByID := make(map[string]*YNABAccount)
-	for _, a := range accounts {
-		accountsByID[a.ID] = a
-	}
-
-	categoriesByID := make(map[string]*YNABCategory)
-	for _, c := range categories {
-		categoriesByID[c.ID] = c
+		return nil, 0, err
 	}
+	log.Printf("loaded %d transactions (since knowledge %d)", len(resp.Data.Transactions), knowledge)
+	return resp.Data.Transactions, resp.Data.ServerKnowledge, nil
+}
 
-	result := make([]*YNABTransaction, 0, len(resp.Data.Transactions))
-	log.Printf("loaded %d transactions", len(resp.Data.Transactions))
-
-	// We'll filter transfers to only show negative amounts (outflows)
-
-	for _, t := range resp.Data.Transactions {
-		account := accountsByID[t.AccountID]
-		if account == nil {
-			log.Printf("account %q not found", t.AccountID)
-			continue
-		}
-
-		// Check if this is a transfer by looking at transfer_account_id
-		isTransfer := t.TransferAccountID != ""
-		var transferAccount *YNABAccount
-		var category *YNABCategory
-
-		if isTransfer {
-			// For transfers, find the target account
-			transferAccount = accountsByID[t.TransferAccountID]
-
-			// Only include transfers between accounts we're tracking
-			if transferAccount == nil {
-				log.Printf("transfer to account %q not in our list, skipping", t.TransferAccountID)
-				continue
-			}
-
-			// For transfers, only show the outflow (negative amount)
-			// This eliminates duplicate display of transfers
-			if t.Amount > 0 {
-				log.Printf("skipping positive transfer amount %d", t.Amount)
-				continue
-			}
-
-			// Create a pseudo-category for the transfer
-			category = &YNABCategory{
-				ID:           "transfer-to-" + t.TransferAccountID,
-				Name:         "Transfer to " + transferAccount.Name,
-				IsTransfer:   true,
-				TransferToID: t.TransferAccountID,
-			}
-		} else {
-			// For regular transactions, get the category
-			category = categoriesByID[t.CategoryID]
-			if category == nil {
-				log.Printf("category %q not found", t.CategoryID)
-				continue
-			}
-		}
-
-		tx := &YNABTransaction{
-			ID:              t.ID,
-			Date:            t.Date,
-			Category:        category,
-			Account:         account,
-			TransferAccount: transferAccount,
-			Comment:         t.Memo,
-			Amount:          t.Amount,
-			AmountUSD:       t.Amount,
-			IsTransfer:      isTransfer,
-		}
-		result = append(result, tx)
+// redactToken hides the YNAB token in logged requests
+func redactToken(s, token string) string {
+	if token == "" {
+		return s
 	}
-	return result, nil
+	return strings.ReplaceAll(s, token, "REDACTED")
 }
 
 func configureCall(req *httpcall.Request, cfg *AppConfig) {
-	req.BaseURL = "https://api.youneedabudget.com/v1/"
+	req.BaseURL = cfg.YNABBaseURL
+	if req.BaseURL == "" {
+		req.BaseURL = defaultYNABBaseURL
+	}
 	req.Headers = map[string][]string{
 		"Authorization": {"Bearer " + cfg.YNABToken},
 	}
+	req.HTTPClient = ynabClient(cfg.YNABToken)
 	req.OnStarted(func(r *httpcall.Request) {
-		log.Printf("> %s: %s\n", r.CallID, r.Curl())
+		log.Printf("> %s: %s\n", r.CallID, redactToken(r.Curl(), cfg.YNABToken))
 	})
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newSeededFakeYNAB(t *testing.T) (*FakeYNAB, *AppConfig) {
+	fake := NewFakeYNAB("Family Budget")
+	t.Cleanup(fake.Close)
+	cfg := newFakeYNABConfig(fake)
+	fake.Seed(cfg)
+	return fake, cfg
+}
+
+func TestFindBudgetID(t *testing.T) {
+	_, cfg := newSeededFakeYNAB(t)
+
+	id, err := findBudgetID(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "B1" {
+		t.Errorf("budget ID = %q", id)
+	}
+
+	cfg.BudgetName = "Other Budget"
+	_, err = findBudgetID(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "Other Budget") {
+		t.Errorf("expected budget not found error, got %v", err)
+	}
+}
+
+func TestCreateYNABTransaction(t *testing.T) {
+	_, cfg := newSeededFakeYNAB(t)
+	ctx := context.Background()
+
+	data, err := LoadYNABData(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cash, assistant := data.Accounts[0], data.Accounts[1]
+
+	tx := &YNABTransaction{Date: "2025-02-01", Category: data.Categories[1], Account: cash, Comment: "Lunch", Amount: -7_000}
+	if err := CreateYNABTransaction(ctx, cfg, data, tx); err != nil {
+		t.Fatal(err)
+	}
+	if tx.ID == "" {
+		t.Error("expected created transaction ID")
+	}
+
+	transfer := &YNABTransaction{Date: "2025-02-02", Category: data.AllCategories[len(data.Categories)+1], Account: cash, Amount: -20_000}
+	if err := CreateYNABTransaction(ctx, cfg, data, transfer); err != nil {
+		t.Fatal(err)
+	}
+	if !transfer.IsTransfer || transfer.TransferAccount != assistant {
+		t.Errorf("expected transfer to %s, got %+v", assistant.Name, transfer)
+	}
+
+	reloaded, err := LoadYNABData(ctx, cfg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *YNABTransaction
+	for _, tx := range reloaded.Transactions {
+		if tx.ID == transfer.ID {
+			found = tx
+		}
+	}
+	if found == nil || !found.IsTransfer || found.TransferAccount.ID != assistant.ID {
+		t.Errorf("reloaded transfer = %+v", found)
+	}
+	if a := reloaded.AccountByID(cash.ID); a.Balance != cash.Balance-27_000 {
+		t.Errorf("Cash balance = %v, wanted %v", a.Balance, cash.Balance-27_000)
+	}
+	if a := reloaded.AccountByID(assistant.ID); a.Balance != assistant.Balance+20_000 {
+		t.Errorf("Held By Assistant balance = %v, wanted %v", a.Balance, assistant.Balance+20_000)
+	}
+}